@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"github.com/guettli/watchall/internal/deltas"
+	"github.com/guettli/watchall/record"
 	"github.com/spf13/cobra"
 )
 
@@ -11,7 +12,13 @@ var deltasCmd = &cobra.Command{
 	Long:  `This reads the files from the local disk and shows the changes. No connection to a cluster is needed.`,
 	Args:  cobra.ExactArgs(1),
 	RunE: func(_ *cobra.Command, args []string) error {
+		err := setIdentities()
+		if err != nil {
+			return err
+		}
+
 		dir := args[0]
+
 		return deltas.Deltas(dir, skipPatterns, onlyPatterns, skipInitial)
 	},
 	SilenceUsage: true,
@@ -21,6 +28,7 @@ var (
 	skipPatterns []string
 	onlyPatterns []string
 	skipInitial  bool
+	identities   []string
 )
 
 func init() {
@@ -28,4 +36,21 @@ func init() {
 	deltasCmd.Flags().StringSliceVar(&skipPatterns, "skip", []string{}, "comma separated list of regex patterns to skip")
 	deltasCmd.Flags().StringSliceVar(&onlyPatterns, "only", []string{}, "comma separated list of regex patterns to show")
 	deltasCmd.Flags().BoolVar(&skipInitial, "skip-initial", false, "skip the initial output of the current state of the resources")
+	deltasCmd.Flags().StringSliceVar(&identities, "identity", []string{}, "age identity file to decrypt a recording which was created with 'record --recipient'. Can be given several times.")
+}
+
+// setIdentities loads the files of --identity, so that encrypted files can be read.
+func setIdentities() error {
+	if len(identities) == 0 {
+		return nil
+	}
+
+	ids, err := record.LoadIdentities(identities)
+	if err != nil {
+		return err
+	}
+
+	record.SetIdentities(ids)
+
+	return nil
 }
@@ -44,27 +44,38 @@ func runLogs() {
 		panic(err.Error())
 	}
 
-	// List all pods
-	pods, err := clientset.CoreV1().Pods(arguments.Namespace).List(ctx, metav1.ListOptions{})
-	if err != nil {
-		panic(err.Error())
+	namespaces := arguments.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
 	}
 
-	for _, pod := range pods.Items {
-		for _, container := range pod.Spec.Containers {
-			req := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
-				Container: container.Name,
-			})
+	for _, namespace := range namespaces {
+		// List all pods
+		pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			panic(err.Error())
+		}
 
-			podLogs, err := req.Stream(ctx)
-			if err != nil {
-				panic(err.Error())
+		for _, pod := range pods.Items {
+			if !arguments.NamespaceSelected(pod.Namespace) {
+				continue
 			}
-			defer podLogs.Close()
 
-			_, err = io.Copy(os.Stdout, podLogs)
-			if err != nil {
-				panic(err.Error())
+			for _, container := range pod.Spec.Containers {
+				req := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+					Container: container.Name,
+				})
+
+				podLogs, err := req.Stream(ctx)
+				if err != nil {
+					panic(err.Error())
+				}
+				defer podLogs.Close()
+
+				_, err = io.Copy(os.Stdout, podLogs)
+				if err != nil {
+					panic(err.Error())
+				}
 			}
 		}
 	}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/guettli/watchall/record"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune dir",
+	Short: "delete old files of a recording",
+	Long:  `This deletes old versions and log files of a recording, which is not running. dir is the directory of one cluster, for example watchall-output/HOST. Files get deleted according to --max-size, --max-age and --max-versions-per-object. The first and the last version of each object are kept. Only the directory layout (--storage=dir or delta) is supported.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		err := setIdentities()
+		if err != nil {
+			return err
+		}
+
+		opts, err := getPruneOptions()
+		if err != nil {
+			return err
+		}
+
+		if !opts.Enabled() {
+			return fmt.Errorf("no limit given. Use --max-size, --max-age or --max-versions-per-object")
+		}
+
+		result, err := record.Prune(args[0], opts, time.Now())
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Pruned %s\n", result)
+
+		return nil
+	},
+	SilenceUsage: true,
+}
+
+var (
+	maxSize              string
+	maxAge               time.Duration
+	maxVersionsPerObject int
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{recordCmd, pruneCmd} {
+		cmd.Flags().StringVar(&maxSize, "max-size", "", "Delete the oldest versions and log files if the recording is bigger. Example: 10Gi")
+		cmd.Flags().DurationVar(&maxAge, "max-age", 0, "Delete versions and log files which are older. Example: 72h")
+		cmd.Flags().IntVar(&maxVersionsPerObject, "max-versions-per-object", 0, "Delete the oldest versions of objects which have more versions")
+	}
+
+	pruneCmd.Flags().StringSliceVar(&identities, "identity", []string{}, "age identity file, needed to prune an encrypted recording of --storage=delta. Can be given several times.")
+	RootCmd.AddCommand(pruneCmd)
+}
+
+// getPruneOptions returns the limits given by --max-size, --max-age and
+// --max-versions-per-object.
+func getPruneOptions() (record.PruneOptions, error) {
+	opts := record.PruneOptions{
+		MaxAge:               maxAge,
+		MaxVersionsPerObject: maxVersionsPerObject,
+	}
+
+	if maxSize != "" {
+		size, err := resource.ParseQuantity(maxSize)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --max-size %q: %w", maxSize, err)
+		}
+
+		opts.MaxSize = size.Value()
+	}
+
+	return opts, nil
+}
@@ -3,12 +3,19 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"maps"
 	"os"
+	"os/signal"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/guettli/watchall/record"
 	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -16,28 +23,205 @@ var recordCmd = &cobra.Command{
 	Use:   "record",
 	Short: "record all changes to resource objects",
 	Long:  longPlaceholder,
-	Run: func(_ *cobra.Command, _ []string) {
-		runRecord(arguments)
+	Run: func(cmd *cobra.Command, _ []string) {
+		runRecord(cmd, arguments)
 	},
 }
 
+var (
+	configFile     string
+	kubeContexts   []string
+	allContexts    bool
+	statusInterval time.Duration
+	duration       time.Duration
+	untilCondition string
+	storage        string
+	segmentSize    string
+	compress       string
+	keyframes      int
+	redactionFile  string
+	redactionKey   string
+	recipients     []string
+)
+
 func init() {
 	recordCmd.Flags().BoolVarP(&arguments.WithLogs, "with-logs", "w", false, "Record logs of pods")
 	recordCmd.Flags().StringVar(&arguments.IgnoreLogLinesFile, "ignore-log-lines-file", "", "Path to a file containing log lines to ignore. Syntax of the line-based file format: 'filename-regex ~~ line-regex'. If line-regex is empty, the pod won't be watched. Lines starting with '#', and empty lines, are ignored. Example to ignore info lines of cilium: kube-system/cilium ~~ level=info. Alternatively, you can use --skip when using the 'deltas' sub-command.")
 	recordCmd.Flags().BoolVarP(&arguments.DisableResourceRecording, "disable-resource-recording", "", false, "Do not watch/record changes to resources. Only meaningful if you only want logs: --with-logs.")
+	recordCmd.Flags().StringSliceVar(&arguments.SkipResources, "skip-resource", record.DefaultSkipResources, "comma separated list of group/resource patterns to skip. Wildcards like 'example.com/*' are supported. The group of core resources is 'core'. Setting this flag replaces the default.")
+	recordCmd.Flags().StringSliceVar(&arguments.OnlyResources, "only-resource", []string{}, "comma separated list of group/resource patterns to record. If set, --skip-resource gets ignored.")
+	recordCmd.Flags().BoolVar(&arguments.SkipClusterScoped, "skip-cluster-scoped", false, "Do not record cluster-scoped resources (like nodes) if --namespace or --exclude-namespace is used.")
+	recordCmd.Flags().StringVarP(&arguments.LabelSelector, "selector", "l", "", "Label selector used for all resources and for the pods of --with-logs. Example: app.kubernetes.io/part-of=foo")
+	recordCmd.Flags().StringVar(&arguments.FieldSelector, "field-selector", "", "Field selector used for all resources and for the pods of --with-logs. Resources which do not support the field get skipped.")
+	recordCmd.Flags().StringVar(&configFile, "config", "", "Path to a YAML config file. Supported keys: skipResources, onlyResources, selector, fieldSelector, selectors (list of resource, labelSelector, fieldSelector to override the selectors for some resources), ignorePaths. Command line flags take precedence.")
+	recordCmd.Flags().StringSliceVar(&kubeContexts, "context", []string{}, "kubeconfig context to record. Can be given several times to record several clusters. Default: the current context")
+	recordCmd.Flags().BoolVar(&allContexts, "all-contexts", false, "Record all contexts of the kubeconfig")
+	recordCmd.Flags().DurationVar(&statusInterval, "status-interval", time.Minute, "Interval to print the status of all recorded clusters. Zero disables the status.")
+	recordCmd.Flags().DurationVar(&duration, "duration", 0, "Stop recording after this duration, for example 30m. Zero means no limit.")
+	recordCmd.Flags().StringVar(&untilCondition, "until", "", "Stop recording as soon as this condition holds. Syntax: 'Kind/namespace/name path == value' (or 'Kind/name' for cluster-scoped objects, and != instead of ==). The path uses the JSONPath syntax of kubectl. Example: 'Cluster/default/foo status.phase == Provisioned'")
+	recordCmd.Flags().StringVar(&storage, "storage", "dir", "How to store the recording. 'dir': one file per version. 'delta': like 'dir', but most versions get stored as JSON merge patch against the previous version. 'journal': append all versions and log lines to JSONL segment files. This avoids creating many small files.")
+	recordCmd.Flags().IntVar(&keyframes, "keyframe-interval", 20, "Store a full version after this number of versions of an object if --storage=delta")
+	recordCmd.Flags().StringVar(&segmentSize, "journal-segment-size", "64Mi", "Size after which a new segment gets started if --storage=journal")
+	recordCmd.Flags().BoolVar(&arguments.KeepUnchanged, "keep-unchanged", false, "Store every version, even if it differs from the last stored version only in fields like resourceVersion or managedFields, or in a path of --ignore-path.")
+	recordCmd.Flags().StringSliceVar(&arguments.IgnorePaths, "ignore-path", []string{}, "Dotted path of a field which gets ignored when deciding whether a version differs from the last stored version. Can be given several times. Escape dots in field names with a backslash. Example: 'metadata.annotations.example\\.com/last-seen'")
+	recordCmd.Flags().StringVar(&compress, "compress", "none", "Compress the stored files (--storage=dir), or the segments (--storage=journal): none, gzip, zstd")
+	recordCmd.Flags().StringVar(&redactionFile, "redaction-rules", "", "Path to a YAML file with rules to redact values before they get stored. The data of Secrets always gets hashed. See README.")
+	recordCmd.Flags().StringVar(&redactionKey, "redaction-key-file", "", "Path to a file with the HMAC key (at least 16 bytes) for hashing redacted values. Use the same key for several recordings to compare their hashes. Default: a random key per session.")
+	recordCmd.Flags().StringSliceVar(&recipients, "recipient", []string{}, "Encrypt all stored files with age for this recipient (a public key like age1...), or for the recipients in this file. Can be given several times. Use 'deltas --identity' to read the recording.")
 	RootCmd.AddCommand(recordCmd)
 }
 
-func runRecord(args record.Arguments) {
+// getStoreFactory returns the StoreFactory selected by --storage.
+func getStoreFactory() (record.StoreFactory, error) {
+	compression, err := record.ParseCompression(compress)
+	if err != nil {
+		return nil, err
+	}
+
+	ageRecipients, err := record.LoadRecipients(recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := record.StoreOptions{
+		Compression: compression,
+		Recipients:  ageRecipients,
+	}
+
+	switch storage {
+	case "dir":
+		return record.DirStoreFactory(opts), nil
+	case "delta":
+		if keyframes < 1 {
+			return nil, fmt.Errorf("invalid --keyframe-interval %d. It must be at least 1", keyframes)
+		}
+
+		opts.KeyframeInterval = keyframes
+
+		return record.DirStoreFactory(opts), nil
+	case "journal":
+		size, err := resource.ParseQuantity(segmentSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --journal-segment-size %q: %w", segmentSize, err)
+		}
+
+		return record.JournalStoreFactory(size.Value(), opts), nil
+	default:
+		return nil, fmt.Errorf("invalid --storage %q. Valid values: dir, delta, journal", storage)
+	}
+}
+
+// cluster is a kubeconfig context to record.
+type cluster struct {
+	context    string
+	host       string
+	kubeconfig clientcmd.ClientConfig
+	stats      *record.Stats
+}
+
+// getClusters returns the clusters selected by --context and --all-contexts.
+// Each cluster gets recorded to its own directory, so two contexts must not
+// point to the same host.
+func getClusters() ([]cluster, error) {
 	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
-	configOverrides := &clientcmd.ConfigOverrides{}
-	kubeconfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
 
+	rawConfig, err := loadingRules.Load()
+	if err != nil {
+		return nil, fmt.Errorf("loading kubeconfig failed: %w", err)
+	}
+
+	contextNames := kubeContexts
+	if allContexts {
+		if len(kubeContexts) > 0 {
+			return nil, fmt.Errorf("--context and --all-contexts can't be used together")
+		}
+
+		contextNames = slices.Sorted(maps.Keys(rawConfig.Contexts))
+	}
+
+	if len(contextNames) == 0 {
+		// The current context, which may be overridden by env vars like KUBECONFIG.
+		contextNames = []string{""}
+	}
+
+	clusters := make([]cluster, 0, len(contextNames))
+	hosts := make(map[string]string)
+
+	for _, contextName := range contextNames {
+		kubeconfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules,
+			&clientcmd.ConfigOverrides{CurrentContext: contextName})
+
+		config, err := kubeconfig.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("context %q: %w", contextName, err)
+		}
+
+		if contextName == "" {
+			contextName = rawConfig.CurrentContext
+		}
+
+		host := record.HostName(config)
+
+		if other, found := hosts[host]; found {
+			return nil, fmt.Errorf("contexts %q and %q both point to %q", other, contextName, host)
+		}
+
+		hosts[host] = contextName
+
+		clusters = append(clusters, cluster{
+			context:    contextName,
+			host:       host,
+			kubeconfig: kubeconfig,
+			stats:      &record.Stats{},
+		})
+	}
+
+	return clusters, nil
+}
+
+// maxDroppedResources is the number of resources shown in the status line of
+// dropped unchanged versions.
+const maxDroppedResources = 5
+
+// printStatus prints the status of each cluster every interval.
+func printStatus(ctx context.Context, clusters []cluster, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		fmt.Printf("Status %s\n", time.Now().Format(time.TimeOnly))
+
+		for _, c := range clusters {
+			fmt.Printf("  context %q (%s): %s\n", c.context, c.host, c.stats.String())
+
+			dropped := c.stats.DroppedString(maxDroppedResources)
+			if dropped != "" {
+				fmt.Printf("    unchanged dropped: %s\n", dropped)
+			}
+		}
+	}
+}
+
+func runRecord(cmd *cobra.Command, args record.Arguments) {
 	if args.DisableResourceRecording && !args.WithLogs {
 		fmt.Println("Error: --skip-recording-resources is only meaningful with --with-logs")
 		os.Exit(1)
 	}
 
+	if configFile != "" {
+		err := applyConfigFile(cmd, configFile, &args)
+		if err != nil {
+			fmt.Printf("Error reading config file %q: %v\n", configFile, err)
+			os.Exit(1)
+		}
+	}
+
 	if args.IgnoreLogLinesFile != "" {
 		err := parseIgnoreLogLinesFile(args.IgnoreLogLinesFile, &args)
 		if err != nil {
@@ -46,13 +230,177 @@ func runRecord(args record.Arguments) {
 		}
 	}
 
-	wg, err := record.RunRecordWithContext(context.Background(), args, kubeconfig)
+	if redactionFile != "" {
+		rules, err := record.LoadRedactionRules(redactionFile)
+		if err != nil {
+			fmt.Printf("Error reading redaction rules: %v\n", err)
+			os.Exit(1)
+		}
+
+		args.RedactionRules = rules
+	}
+
+	if redactionKey != "" {
+		key, err := record.LoadRedactionKey(redactionKey)
+		if err != nil {
+			fmt.Printf("Error reading redaction key: %v\n", err)
+			os.Exit(1)
+		}
+
+		args.RedactionKey = key
+	} else {
+		// One key for all clusters, so their hashes can be compared.
+		key, err := record.NewRedactionKey()
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+
+		args.RedactionKey = key
+	}
+
+	if untilCondition != "" {
+		condition, err := record.ParseUntilCondition(untilCondition)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+
+		args.Until = condition
+	}
+
+	newStore, err := getStoreFactory()
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	args.NewStore = newStore
+
+	args.Retention, err = getPruneOptions()
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
 
-	wg.Wait()
+	if args.Retention.Enabled() && storage == "journal" {
+		fmt.Println("Error: --max-size, --max-age and --max-versions-per-object are not supported with --storage=journal")
+		os.Exit(1)
+	}
+
+	clusters, err := getClusters()
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	// Stop cleanly on Ctrl-C. A second Ctrl-C kills the process.
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// finished gets closed before the deferred stop() cancels sigCtx.
+	finished := make(chan struct{})
+	defer close(finished)
+
+	go func() {
+		select {
+		case <-sigCtx.Done():
+			stop()
+			fmt.Println("Stopping. Waiting for pending writes. Press Ctrl-C again to abort.")
+		case <-finished:
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(sigCtx)
+	defer cancel()
+
+	if duration > 0 {
+		time.AfterFunc(duration, func() {
+			fmt.Printf("Recorded for %s, stopping.\n", duration)
+			cancel()
+		})
+	}
+
+	if args.Until != nil {
+		go func() {
+			select {
+			case <-args.Until.Done():
+				fmt.Printf("Condition %q holds, stopping.\n", args.Until.String())
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	wgs := make([]*sync.WaitGroup, 0, len(clusters))
+
+	for _, c := range clusters {
+		clusterArgs := args
+		clusterArgs.Stats = c.stats
+
+		wg, err := record.RunRecordWithContext(ctx, clusterArgs, c.kubeconfig)
+		if err != nil {
+			fmt.Printf("context %q: %s\n", c.context, err.Error())
+
+			// Finish the sessions of the clusters which are already recording.
+			cancel()
+
+			for _, wg := range wgs {
+				wg.Wait()
+			}
+
+			os.Exit(1)
+		}
+
+		wgs = append(wgs, wg)
+	}
+
+	if statusInterval > 0 {
+		go printStatus(ctx, clusters, statusInterval)
+	}
+
+	for _, wg := range wgs {
+		wg.Wait()
+	}
+
+	for _, c := range clusters {
+		fmt.Printf("Recording of context %q (%s) finished: %s\n", c.context, c.host, c.stats.String())
+	}
+}
+
+// applyConfigFile copies the values of the config file to args, except for
+// values which were given on the command line.
+func applyConfigFile(cmd *cobra.Command, filename string, args *record.Arguments) error {
+	config, err := record.LoadConfig(filename)
+	if err != nil {
+		return err
+	}
+
+	flags := cmd.Flags()
+
+	if config.SkipResources != nil && !flags.Changed("skip-resource") {
+		args.SkipResources = config.SkipResources
+	}
+
+	if config.OnlyResources != nil && !flags.Changed("only-resource") {
+		args.OnlyResources = config.OnlyResources
+	}
+
+	if config.Selector != "" && !flags.Changed("selector") {
+		args.LabelSelector = config.Selector
+	}
+
+	if config.FieldSelector != "" && !flags.Changed("field-selector") {
+		args.FieldSelector = config.FieldSelector
+	}
+
+	args.Selectors = config.Selectors
+
+	if config.IgnorePaths != nil && !flags.Changed("ignore-path") {
+		args.IgnorePaths = config.IgnorePaths
+	}
+
+	return nil
 }
 
 func parseIgnoreLogLinesFile(filename string, args *record.Arguments) error {
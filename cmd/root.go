@@ -32,5 +32,6 @@ func init() {
 	// will be global for your application.
 	RootCmd.PersistentFlags().BoolVarP(&arguments.Verbose, "verbose", "v", false, "Create more output")
 	RootCmd.PersistentFlags().StringVarP(&arguments.OutputDirectory, "outdir", "o", "watchall-output", "Directory to store output")
-	RootCmd.PersistentFlags().StringVarP(&arguments.Namespace, "namespace", "n", "", "Kubernetes namespace to watch (default: all namespaces)")
+	RootCmd.PersistentFlags().StringSliceVarP(&arguments.Namespaces, "namespace", "n", []string{}, "comma separated list of Kubernetes namespaces to watch (default: all namespaces)")
+	RootCmd.PersistentFlags().StringSliceVar(&arguments.ExcludeNamespaces, "exclude-namespace", []string{}, "comma separated list of Kubernetes namespaces to ignore")
 }
@@ -3,7 +3,9 @@ module github.com/guettli/watchall
 go 1.25.0
 
 require (
+	filippo.io/age v1.2.1
 	github.com/gavv/cobradoc v1.1.0
+	github.com/klauspost/compress v1.18.0
 	github.com/spf13/cobra v1.7.0
 	k8s.io/api v0.32.2
 	k8s.io/apimachinery v0.32.2
@@ -36,6 +38,7 @@ require (
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/crypto v0.28.0 // indirect
 	golang.org/x/net v0.30.0 // indirect
 	golang.org/x/oauth2 v0.23.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
@@ -2,6 +2,7 @@ package deltas
 
 import (
 	"bytes"
+	"cmp"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -16,7 +17,6 @@ import (
 	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/serializer/json"
-	"k8s.io/apimachinery/pkg/util/yaml"
 )
 
 var resourcesToSkip = []string{
@@ -26,6 +26,10 @@ var resourcesToSkip = []string{
 type fileType struct {
 	basename string
 	path     string
+
+	// sequence is the number of the file in the recording session. It is
+	// zero for recordings of older versions.
+	sequence uint64
 }
 
 func (f fileType) String() string {
@@ -55,22 +59,21 @@ func Deltas(baseDir string, skipPatterns, onlyPatterns []string, skipInitial boo
 		onlyRegex = append(onlyRegex, r)
 	}
 
-	records, err := filepath.Glob(filepath.Join(baseDir, "record-*"))
+	startTimestamp, endTimestamp, err := findSession(baseDir)
 	if err != nil {
-		return fmt.Errorf("os.Glob() failed: %w", err)
+		return err
 	}
 
-	if len(records) == 0 {
-		return fmt.Errorf("no record-YYYYMM... file found in %s", baseDir)
+	entries, err := record.ReadJournal(baseDir, startTimestamp)
+	if err != nil {
+		return fmt.Errorf("record.ReadJournal() failed: %w", err)
 	}
 
-	slices.Sort(records)
-
-	record := records[len(records)-1]
-	startTimestamp := strings.SplitN(filepath.Base(record), "-", 2)[1]
-	fmt.Printf("Using %q as start timestamp\n", record)
+	if len(entries) > 0 {
+		return journalDeltas(entries, skipRegex, onlyRegex, !skipInitial)
+	}
 
-	var files []fileType
+	var files, logFiles, gapFiles []fileType
 
 	err = filepath.WalkDir(baseDir, func(path string, info os.DirEntry, err error) error {
 		if err != nil {
@@ -85,10 +88,19 @@ func Deltas(baseDir string, skipPatterns, onlyPatterns []string, skipInitial boo
 			return nil
 		}
 
+		// The index, and the temporary file used while pruning.
+		if strings.HasPrefix(info.Name(), record.IndexFile) {
+			return nil
+		}
+
 		if info.Name() < startTimestamp {
 			return nil
 		}
 
+		if endTimestamp != "" && info.Name() > endTimestamp {
+			return nil
+		}
+
 		if doSkip(skipRegex, onlyRegex, path) {
 			return nil
 		}
@@ -98,10 +110,28 @@ func Deltas(baseDir string, skipPatterns, onlyPatterns []string, skipInitial boo
 			return fmt.Errorf("filepath.Rel() failed: %w", err)
 		}
 
-		files = append(files, fileType{
+		_, seq, _, err := record.ParseVersionFileName(info.Name())
+		if err != nil {
+			return fmt.Errorf("record.ParseVersionFileName() failed: %w", err)
+		}
+
+		file := fileType{
 			basename: info.Name(),
 			path:     p,
-		})
+			sequence: seq,
+		}
+
+		if record.IsLogFile(info.Name()) {
+			logFiles = append(logFiles, file)
+			return nil
+		}
+
+		if record.IsLogGapFile(info.Name()) {
+			gapFiles = append(gapFiles, file)
+			return nil
+		}
+
+		files = append(files, file)
 
 		return nil
 	})
@@ -110,19 +140,177 @@ func Deltas(baseDir string, skipPatterns, onlyPatterns []string, skipInitial boo
 	}
 
 	sort.Slice(files, func(i, j int) bool {
+		if files[i].sequence != files[j].sequence {
+			return files[i].sequence < files[j].sequence
+		}
+
 		return files[i].basename < files[j].basename
 	})
 
+	logLines, err := readLogFiles(baseDir, logFiles, gapFiles)
+	if err != nil {
+		return err
+	}
+
+	dirs := make(objectDirs)
+
+	// The log lines get shown between the versions, ordered by time.
 	for _, file := range files {
-		err := showFile(baseDir, file, startTimestamp, !skipInitial)
+		observed, err := baseNameToTimestamp(file.basename)
+		if err != nil {
+			return err
+		}
+
+		for len(logLines) > 0 && logLines[0].Timestamp.Before(observed) {
+			logLines[0].print()
+			logLines = logLines[1:]
+		}
+
+		err = showFile(baseDir, dirs, file, startTimestamp, !skipInitial)
 		if err != nil {
 			return fmt.Errorf("showFile() failed: %w", err)
 		}
 	}
 
+	for _, line := range logLines {
+		line.print()
+	}
+
 	return nil
 }
 
+// logLine is a line of a log file, or a gap of a log if gap is set. path is
+// the path of the file. For gaps Timestamp is the start of the gap.
+type logLine struct {
+	record.LogLine
+	path string
+	gap  *record.LogGap
+}
+
+// readLogFiles returns the lines of the log files and the gaps, ordered by
+// time. Lines without timestamp get the time of the previous line, or the
+// time of the file.
+func readLogFiles(baseDir string, logFiles, gapFiles []fileType) ([]logLine, error) {
+	var lines []logLine
+
+	for _, file := range logFiles {
+		t, err := baseNameToTimestamp(file.basename)
+		if err != nil {
+			return nil, err
+		}
+
+		fileLines, err := record.ReadLogFile(filepath.Join(baseDir, file.path, file.basename))
+		if err != nil {
+			return nil, fmt.Errorf("record.ReadLogFile() failed: %w", err)
+		}
+
+		for _, line := range fileLines {
+			if line.Timestamp.IsZero() {
+				line.Timestamp = t
+			}
+
+			t = line.Timestamp
+			lines = append(lines, logLine{LogLine: line, path: file.String()})
+		}
+	}
+
+	for _, file := range gapFiles {
+		gap, err := record.ReadLogGap(filepath.Join(baseDir, file.path, file.basename))
+		if err != nil {
+			return nil, fmt.Errorf("record.ReadLogGap() failed: %w", err)
+		}
+
+		lines = append(lines, newLogGap(file.String(), gap))
+	}
+
+	sortLogLines(lines)
+
+	return lines, nil
+}
+
+func newLogGap(path string, gap record.LogGap) logLine {
+	return logLine{LogLine: record.LogLine{Timestamp: gap.From}, path: path, gap: &gap}
+}
+
+// sortLogLines sorts by time. A gap comes after the line it starts with.
+func sortLogLines(lines []logLine) {
+	slices.SortStableFunc(lines, func(a, b logLine) int {
+		isGap := func(l logLine) int {
+			if l.gap != nil {
+				return 1
+			}
+
+			return 0
+		}
+
+		return cmp.Or(a.Timestamp.Compare(b.Timestamp), isGap(a)-isGap(b))
+	})
+}
+
+// print shows a log line or a gap.
+func (l logLine) print() {
+	if l.gap != nil {
+		fmt.Printf("Log gap: %s\n%s\n\n", l.path, l.gap)
+		return
+	}
+
+	fmt.Printf("Log: %s\n%s\n\n", l.path, l.String())
+}
+
+// findSession returns the timestamps of the start and end markers of the
+// last recording session. The end timestamp is empty if the session has no
+// end marker.
+func findSession(baseDir string) (startTimestamp, endTimestamp string, err error) {
+	markers, err := filepath.Glob(filepath.Join(baseDir, record.StartMarkerPrefix+"*"))
+	if err != nil {
+		return "", "", fmt.Errorf("os.Glob() failed: %w", err)
+	}
+
+	var starts, ends []string
+
+	for _, marker := range markers {
+		name := filepath.Base(marker)
+		if strings.HasPrefix(name, record.EndMarkerPrefix) {
+			ends = append(ends, strings.TrimPrefix(name, record.EndMarkerPrefix))
+			continue
+		}
+
+		starts = append(starts, strings.TrimPrefix(name, record.StartMarkerPrefix))
+	}
+
+	if len(starts) == 0 {
+		return "", "", fmt.Errorf("no record-YYYYMM... file found in %s", baseDir)
+	}
+
+	slices.Sort(starts)
+	slices.Sort(ends)
+
+	startTimestamp = starts[len(starts)-1]
+	fmt.Printf("Using %q as start timestamp\n", filepath.Join(baseDir, record.StartMarkerPrefix+startTimestamp))
+
+	for _, end := range ends {
+		if end >= startTimestamp {
+			endTimestamp = end
+			break
+		}
+	}
+
+	info, err := record.ReadSessionInfo(baseDir, startTimestamp)
+	if err != nil {
+		return "", "", fmt.Errorf("record.ReadSessionInfo() failed: %w", err)
+	}
+
+	if info.RedactionKeyID != "" {
+		fmt.Printf("Redacted values are hashed with the key %s\n", info.RedactionKeyID)
+	}
+
+	if endTimestamp == "" {
+		fmt.Printf("WARNING: The session has no %s marker. The recording is still running, or it ended abnormally.\n", record.EndMarkerPrefix)
+	}
+
+	return startTimestamp, endTimestamp, nil
+}
+
 func doSkip(skipRegex, onlyRegex []*regexp.Regexp, path string) bool {
 	if len(onlyRegex) > 0 {
 		for _, r := range onlyRegex {
@@ -143,7 +331,50 @@ func doSkip(skipRegex, onlyRegex []*regexp.Regexp, path string) bool {
 	return false
 }
 
-func showFile(baseDir string, file fileType, startTimestamp string, showInitialYaml bool) error {
+// objectDir is the content of an object directory. It gets read once for all
+// versions of the object. Reading the index of an encrypted recording is
+// expensive, because each line is encrypted.
+type objectDir struct {
+	// versions are the basenames of the stored versions, the newest first.
+	versions []string
+	index    map[string]record.VersionMeta
+}
+
+// objectDirs caches the object directories. The key is the absolute path.
+type objectDirs map[string]*objectDir
+
+func (d objectDirs) get(absDir string) (*objectDir, error) {
+	dir, found := d[absDir]
+	if found {
+		return dir, nil
+	}
+
+	dirEntries, err := os.ReadDir(absDir)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadDir() failed: %w", err)
+	}
+
+	dir = &objectDir{}
+
+	for _, entry := range dirEntries {
+		if !entry.IsDir() && record.IsVersionFile(entry.Name()) {
+			dir.versions = append(dir.versions, entry.Name())
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(dir.versions)))
+
+	dir.index, err = record.ReadIndex(absDir)
+	if err != nil {
+		return nil, fmt.Errorf("record.ReadIndex() failed: %w", err)
+	}
+
+	d[absDir] = dir
+
+	return dir, nil
+}
+
+func showFile(baseDir string, dirs objectDirs, file fileType, startTimestamp string, showInitialYaml bool) error {
 	if file.basename < startTimestamp {
 		// fmt.Printf("Skipping %q because before %s %s\n", file.String(), startTimestamp, previous)
 		return nil
@@ -156,46 +387,27 @@ func showFile(baseDir string, file fileType, startTimestamp string, showInitialY
 		}
 	}
 
-	if strings.HasSuffix(file.basename, ".log") {
-		data, err := os.ReadFile(filepath.Join(baseDir, file.path, file.basename))
-		if err != nil {
-			return fmt.Errorf("os.ReadFile() failed: %w", err)
-		}
-
-		fmt.Printf("Log: %s\n%s\n\n", file.String(), data)
-
-		return nil
-	}
+	// Compressed files have an additional suffix like ".gz".
+	name := record.TrimCompressionSuffix(file.basename)
 
 	absDir := filepath.Join(baseDir, file.path)
-	// find previous file
-	dirEntries, err := os.ReadDir(absDir)
+
+	dir, err := dirs.get(absDir)
 	if err != nil {
-		return fmt.Errorf("os.ReadDir() failed: %w", err)
+		return err
 	}
 
-	sort.Slice(dirEntries, func(i, j int) bool {
-		return dirEntries[i].Name() > dirEntries[j].Name()
-	})
-
+	// find previous file
 	found := false
 	previous := ""
 
-	for _, entry := range dirEntries {
-		if entry.IsDir() {
-			continue
-		}
-
-		if !strings.HasSuffix(entry.Name(), ".yaml") {
-			continue
-		}
-
+	for _, version := range dir.versions {
 		if found {
-			previous = entry.Name()
+			previous = version
 			break
 		}
 
-		if entry.Name() == file.basename {
+		if version == file.basename {
 			found = true
 		}
 	}
@@ -204,113 +416,154 @@ func showFile(baseDir string, file fileType, startTimestamp string, showInitialY
 		return fmt.Errorf("internal error. Not found: %q %s", file.path, file.basename)
 	}
 
-	if previous == "" {
-		return showInitialFile(absDir, file, showInitialYaml)
+	meta, hasMeta := dir.index[file.basename]
+
+	if strings.HasSuffix(name, record.TombstoneSuffix) {
+		return showTombstone(absDir, file)
 	}
 
-	return compareTwoYamlFiles(baseDir, filepath.Join(absDir, previous),
-		filepath.Join(absDir, file.basename))
-}
+	// An object which was deleted and created again gets shown like a new object.
+	if previous == "" || strings.HasSuffix(record.TrimCompressionSuffix(previous), record.TombstoneSuffix) {
+		// Objects which were created while recording are always shown.
+		if hasMeta && !meta.InitialList {
+			return showInitialFile(absDir, file, "ADDED")
+		}
 
-func showInitialFile(absDir string, file fileType, showInitialYaml bool) error {
-	if !showInitialYaml {
-		return nil
+		if !showInitialYaml {
+			return nil
+		}
+
+		return showInitialFile(absDir, file, "Initial YAML")
 	}
 
-	content, err := os.ReadFile(filepath.Join(absDir, file.basename))
+	return compareTwoYamlFiles(baseDir, filepath.Join(absDir, previous),
+		filepath.Join(absDir, file.basename), meta)
+}
+
+func showInitialFile(absDir string, file fileType, header string) error {
+	obj, err := readYamlFile(filepath.Join(absDir, file.basename))
 	if err != nil {
-		return fmt.Errorf("os.ReadFile() failed: %w", err)
+		return err
 	}
 
-	obj, err := yamlToUnstructured(content)
+	return printObject(header, file.String(), obj)
+}
+
+// showTombstone shows the last known state of a deleted object.
+func showTombstone(absDir string, file fileType) error {
+	obj, err := readYamlFile(filepath.Join(absDir, file.basename))
 	if err != nil {
-		return fmt.Errorf("failed to decode first YAML: %w", err)
+		return err
 	}
 
-	stripIrrelevantFields(obj)
+	return printTombstone(file.String(), obj)
+}
 
-	s, err := unstructuredToString(obj)
+// compareTwoYamlFiles shows the diff of two versions. meta describes the
+// second version. It is empty for recordings without index.
+func compareTwoYamlFiles(baseDir, f1, f2 string, meta record.VersionMeta) error {
+	obj1, err := readYamlFile(f1)
 	if err != nil {
-		return fmt.Errorf("unstructuredToString failed %q: %w", file.basename, err)
+		return err
 	}
 
-	fmt.Printf("\nInitial YAML: %s\n%s", file.String(), s)
+	obj2, err := readYamlFile(f2)
+	if err != nil {
+		return err
+	}
 
-	return nil
-}
+	p, err := filepath.Rel(baseDir, f1)
+	if err != nil {
+		return fmt.Errorf("filepath.Rel() failed: %w", err)
+	}
 
-func compareTwoYamlFiles(baseDir, f1, f2 string) error {
-	yaml1, err := os.ReadFile(f1)
+	time1, err := baseNameToTimestamp(filepath.Base(f1))
 	if err != nil {
-		return fmt.Errorf("failed to read %q: %w", f1, err)
+		return fmt.Errorf("baseNameToTimestamp failed: %w", err)
 	}
 
-	yaml2, err := os.ReadFile(f2)
+	time2, err := baseNameToTimestamp(filepath.Base(f2))
 	if err != nil {
-		return fmt.Errorf("failed to read %q: %w", f2, err)
+		return fmt.Errorf("baseNameToTimestamp failed: %w", err)
 	}
 
-	// Decode the YAML into unstructured objects
-	obj1, err := yamlToUnstructured(yaml1)
+	return printDiff(p, filepath.Base(f2), obj1, obj2, time2.Sub(time1), meta.ResourceVersion)
+}
+
+// readYamlFile reads a stored version. Patches get applied to the preceding
+// keyframe, so the result is always the full object.
+func readYamlFile(file string) (*unstructured.Unstructured, error) {
+	obj, err := record.ReadVersion(file)
 	if err != nil {
-		return fmt.Errorf("failed to decode first YAML: %q %w", f1, err)
+		return nil, fmt.Errorf("record.ReadVersion() failed: %w", err)
 	}
 
-	obj2, err := yamlToUnstructured(yaml2)
+	return obj, nil
+}
+
+// printObject shows a complete object, for example the initial state.
+func printObject(header, label string, obj *unstructured.Unstructured) error {
+	record.StripIrrelevantFields(obj)
+
+	s, err := unstructuredToString(obj)
 	if err != nil {
-		return fmt.Errorf("failed to decode second YAML: %q %w", f2, err)
+		return fmt.Errorf("unstructuredToString failed %q: %w", label, err)
+	}
+
+	fmt.Printf("\n%s: %s\n%s", header, label, s)
+
+	return nil
+}
+
+// printTombstone shows the last known state of a deleted object.
+func printTombstone(label string, obj *unstructured.Unstructured) error {
+	name := obj.GetName()
+	if obj.GetNamespace() != "" {
+		name = obj.GetNamespace() + "/" + name
 	}
 
+	return printObject(fmt.Sprintf("DELETED %s %s", obj.GetKind(), name), label, obj)
+}
+
+// printDiff shows the changes from obj1 to obj2. label1 is the path of the
+// first version, name2 the basename of the second version.
+func printDiff(label1, name2 string, obj1, obj2 *unstructured.Unstructured, d time.Duration, resourceVersion string) error {
 	// Strip irrelevant fields (like resourceVersion)
-	stripIrrelevantFields(obj1)
-	stripIrrelevantFields(obj2)
+	record.StripIrrelevantFields(obj1)
+	record.StripIrrelevantFields(obj2)
 
 	// Compare the objects
 	if equality.Semantic.DeepEqual(obj1, obj2) {
-		fmt.Printf("No changes in %q %q\n\n", f1, f2)
+		fmt.Printf("No changes in %q %q\n\n", label1, name2)
 		return nil
 	}
 
 	s1, err := unstructuredToString(obj1)
 	if err != nil {
-		return fmt.Errorf("unstructuredToString failed %q: %w", f1, err)
+		return fmt.Errorf("unstructuredToString failed %q: %w", label1, err)
 	}
 
 	s2, err := unstructuredToString(obj2)
 	if err != nil {
-		return fmt.Errorf("unstructuredToString failed %q: %w", f2, err)
-	}
-
-	diff := textdiff.Unified(filepath.Base(f1), filepath.Base(f2), s1, s2)
-
-	p, err := filepath.Rel(baseDir, f1)
-	if err != nil {
-		return fmt.Errorf("filepath.Rel() failed: %w", err)
+		return fmt.Errorf("unstructuredToString failed %q: %w", name2, err)
 	}
 
-	time1, err := baseNameToTimestamp(filepath.Base(f1))
-	if err != nil {
-		return fmt.Errorf("baseNameToTimestamp failed: %w", err)
-	}
+	diff := textdiff.Unified(filepath.Base(label1), name2, s1, s2)
 
-	time2, err := baseNameToTimestamp(filepath.Base(f2))
-	if err != nil {
-		return fmt.Errorf("baseNameToTimestamp failed: %w", err)
+	info := d.Truncate(time.Second).String()
+	if resourceVersion != "" {
+		info += ", resourceVersion " + resourceVersion
 	}
 
-	d := time2.Sub(time1)
-	fmt.Printf("\nDiff of %q %q (%s)\n%s\n\n", p, filepath.Base(f2),
-		d.Truncate(time.Second).String(), diff)
+	fmt.Printf("\nDiff of %q %q (%s)\n%s\n\n", label1, name2, info, diff)
 
 	return nil
 }
 
 func baseNameToTimestamp(baseName string) (time.Time, error) {
-	baseName = strings.TrimSuffix(baseName, ".yaml")
-
-	t, err := time.Parse(record.TimeFormat, baseName)
+	t, _, _, err := record.ParseVersionFileName(baseName)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("time.Parse() format=%s failed: %w", record.TimeFormat, err)
+		return time.Time{}, fmt.Errorf("record.ParseVersionFileName() failed: %w", err)
 	}
 
 	return t, nil
@@ -328,30 +581,3 @@ func unstructuredToString(obj *unstructured.Unstructured) (string, error) {
 
 	return buffer.String(), nil
 }
-
-func yamlToUnstructured(yamlData []byte) (*unstructured.Unstructured, error) {
-	// Convert YAML to JSON
-	jsonData, err := yaml.ToJSON(yamlData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to convert YAML to JSON: %w", err)
-	}
-
-	// Unmarshal JSON into an unstructured.Unstructured object
-	obj := &unstructured.Unstructured{}
-
-	err = obj.UnmarshalJSON(jsonData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal JSON to Unstructured: %w", err)
-	}
-
-	return obj, nil
-}
-
-func stripIrrelevantFields(obj *unstructured.Unstructured) {
-	// Remove metadata fields that are not relevant
-	unstructured.RemoveNestedField(obj.Object, "metadata", "managedFields")
-	unstructured.RemoveNestedField(obj.Object, "metadata", "annotations", "kubectl.kubernetes.io/last-applied-configuration")
-	unstructured.RemoveNestedField(obj.Object, "metadata", "resourceVersion")
-	unstructured.RemoveNestedField(obj.Object, "metadata", "generation")
-	unstructured.RemoveNestedField(obj.Object, "metadata", "uid")
-}
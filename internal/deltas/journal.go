@@ -0,0 +1,113 @@
+package deltas
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/guettli/watchall/record"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// journalDeltas shows the changes of a session which was recorded with a
+// record.JournalStore. The entries must be ordered by sequence number.
+func journalDeltas(entries []record.JournalEntry, skipRegex, onlyRegex []*regexp.Regexp, showInitialYaml bool) error {
+	type version struct {
+		path     string
+		obj      *unstructured.Unstructured
+		observed time.Time
+	}
+
+	// previous contains the last version of each object. Key is the directory
+	// of the object in the layout of record.DirStore.
+	previous := make(map[string]version)
+
+	// The log lines get shown between the versions, ordered by time.
+	var logLines []logLine
+
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Type != record.JournalLogType && entry.Type != record.JournalLogGapType {
+			continue
+		}
+
+		path := entry.Path()
+		if doSkip(skipRegex, onlyRegex, path) {
+			continue
+		}
+
+		if entry.Type == record.JournalLogGapType {
+			logLines = append(logLines, newLogGap(path, entry.LogGap()))
+			continue
+		}
+
+		line := entry.LogLine()
+		if line.Timestamp.IsZero() {
+			line.Timestamp = line.Observed
+		}
+
+		logLines = append(logLines, logLine{LogLine: line, path: path})
+	}
+
+	sortLogLines(logLines)
+
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Type == record.JournalLogType || entry.Type == record.JournalLogGapType {
+			continue
+		}
+
+		for len(logLines) > 0 && logLines[0].Timestamp.Before(entry.Observed) {
+			logLines[0].print()
+			logLines = logLines[1:]
+		}
+
+		path := entry.Path()
+		skip := doSkip(skipRegex, onlyRegex, path)
+
+		obj := &unstructured.Unstructured{}
+
+		err := obj.UnmarshalJSON(entry.Object)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal object of %q: %w", path, err)
+		}
+
+		key := filepath.Dir(path)
+		prev, found := previous[key]
+
+		if entry.Type == string(watch.Deleted) {
+			delete(previous, key)
+		} else {
+			previous[key] = version{path: path, obj: obj.DeepCopy(), observed: entry.Observed}
+		}
+
+		if skip {
+			continue
+		}
+
+		switch {
+		case entry.Type == string(watch.Deleted):
+			err = printTombstone(path, obj)
+		case found:
+			err = printDiff(prev.path, filepath.Base(path), prev.obj.DeepCopy(), obj,
+				entry.Observed.Sub(prev.observed), entry.ResourceVersion)
+		case !entry.InitialList:
+			// Objects which were created while recording are always shown.
+			err = printObject("ADDED", path, obj)
+		case showInitialYaml:
+			err = printObject("Initial YAML", path, obj)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, line := range logLines {
+		line.print()
+	}
+
+	return nil
+}
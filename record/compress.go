@@ -0,0 +1,276 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the compression of stored files.
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+const (
+	gzipSuffix = ".gz"
+	zstdSuffix = ".zst"
+)
+
+// ParseCompression parses the value of the --compress flag.
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "", "none":
+		return CompressionNone, nil
+	case string(CompressionGzip):
+		return CompressionGzip, nil
+	case string(CompressionZstd):
+		return CompressionZstd, nil
+	default:
+		return "", fmt.Errorf("invalid compression %q. Valid values: none, gzip, zstd", s)
+	}
+}
+
+// Suffix returns the suffix which gets appended to the names of compressed files.
+func (c Compression) Suffix() string {
+	switch c {
+	case CompressionGzip:
+		return gzipSuffix
+	case CompressionZstd:
+		return zstdSuffix
+	default:
+		return ""
+	}
+}
+
+// writeCloseFlusher is implemented by the writers of all compressions.
+type writeCloseFlusher interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// nopFlusher is used if there is no compression.
+type nopFlusher struct {
+	io.Writer
+}
+
+func (nopFlusher) Close() error { return nil }
+func (nopFlusher) Flush() error { return nil }
+
+// newWriter returns a writer which compresses to w. Closing it does not close w.
+func (c Compression) newWriter(w io.Writer) (writeCloseFlusher, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		// Many files are open at the same time, for example a log file per
+		// container. The defaults would use several goroutines and big
+		// buffers per file.
+		enc, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(zstdStreamWindowSize))
+		if err != nil {
+			return nil, fmt.Errorf("zstd.NewWriter() failed: %w", err)
+		}
+
+		return enc, nil
+	default:
+		return nopFlusher{w}, nil
+	}
+}
+
+// zstdStreamWindowSize is the window size of zstd writers of appended files.
+const zstdStreamWindowSize = 256 << 10
+
+// zstdEncoder compresses whole files. It is shared, because creating an
+// encoder is expensive.
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, fmt.Errorf("zstd.NewWriter() failed: %w", err)
+	}
+
+	return enc, nil
+})
+
+// compress returns data compressed with c.
+func (c Compression) compress(data []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionZstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+
+		return enc.EncodeAll(data, nil), nil
+	}
+
+	var buf bytes.Buffer
+
+	w, err := c.newWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, fmt.Errorf("compressing failed: %w", err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("compressing failed: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// TrimCompressionSuffix removes the suffixes of compressed and encrypted
+// files. Other names get returned unchanged.
+func TrimCompressionSuffix(name string) string {
+	name = strings.TrimSuffix(name, EncryptionSuffix)
+
+	for _, suffix := range []string{gzipSuffix, zstdSuffix} {
+		if trimmed, found := strings.CutSuffix(name, suffix); found {
+			return trimmed
+		}
+	}
+
+	return name
+}
+
+// fileCompression returns the compression of a file, based on the suffix of the name.
+func fileCompression(name string) Compression {
+	name = strings.TrimSuffix(name, EncryptionSuffix)
+
+	switch {
+	case strings.HasSuffix(name, gzipSuffix):
+		return CompressionGzip
+	case strings.HasSuffix(name, zstdSuffix):
+		return CompressionZstd
+	default:
+		return CompressionNone
+	}
+}
+
+// OpenFile opens a file of a recording. Encrypted and compressed files get
+// decrypted and decompressed transparently, based on the suffix of the name.
+// See SetIdentities.
+func OpenFile(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open() failed: %w", err)
+	}
+
+	var r io.Reader = f
+
+	if IsEncrypted(name) {
+		r, err = decrypt(name, f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	switch fileCompression(name) {
+	case CompressionGzip:
+		gz, err := gzip.NewReader(r)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// The file gets appended, and nothing was flushed yet.
+			return &readCloser{Reader: truncatedReader{}, close: f.Close}, nil
+		}
+
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("gzip.NewReader() failed %q: %w", name, err)
+		}
+
+		return &readCloser{Reader: gz, close: func() error {
+			return errors.Join(gz.Close(), f.Close())
+		}}, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("zstd.NewReader() failed %q: %w", name, err)
+		}
+
+		return &readCloser{Reader: zr, close: func() error {
+			zr.Close()
+			return f.Close()
+		}}, nil
+	default:
+		return &readCloser{Reader: r, close: f.Close}, nil
+	}
+}
+
+// ReadFile reads a file of a recording like os.ReadFile. Compressed files get
+// decompressed transparently.
+func ReadFile(name string) ([]byte, error) {
+	r, err := OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading %q failed: %w", name, err)
+	}
+
+	return data, nil
+}
+
+// readLines calls fn for each line of r, without the newline. Files which
+// get appended, or which were not closed because the recorder was killed, end
+// with an incomplete line, or the decompression or decryption fails with
+// io.ErrUnexpectedEOF. In both cases the incomplete line gets skipped, and
+// truncated is true.
+func readLines(r io.Reader, fn func(line []byte) error) (truncated bool, err error) {
+	br := bufio.NewReader(r)
+
+	for {
+		line, err := br.ReadBytes('\n')
+
+		switch {
+		case err == nil:
+			err = fn(line[:len(line)-1])
+			if err != nil {
+				return false, err
+			}
+		case errors.Is(err, io.EOF):
+			return len(line) > 0, nil
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return true, nil
+		default:
+			return false, err
+		}
+	}
+}
+
+// truncatedReader is the content of a compressed file without a complete header.
+type truncatedReader struct{}
+
+func (truncatedReader) Read([]byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
@@ -0,0 +1,40 @@
+package record
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestReadCompressedVersion(t *testing.T) {
+	for _, compression := range []Compression{CompressionGzip, CompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			baseDir := t.TempDir()
+			start := time.Date(2025, 2, 27, 15, 0, 0, 0, time.UTC)
+
+			names := recordTestSession(t, baseDir, StoreOptions{Compression: compression}, "first", start, 3)
+			dir := objectDir(baseDir)
+
+			for i, prefix := range names {
+				name := findVersionFile(t, dir, prefix)
+				if !strings.HasSuffix(name, compression.Suffix()) {
+					t.Errorf("%q is not compressed with %s", name, compression)
+				}
+
+				obj, err := ReadVersion(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				want := fmt.Sprint(i + 1)
+				if got, _, _ := unstructured.NestedString(obj.Object, "data", "version"); got != want {
+					t.Errorf("%q: got version %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
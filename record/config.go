@@ -0,0 +1,46 @@
+package record
+
+import (
+	"fmt"
+	"os"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the content of the file given by `record --config`. Options which
+// are given on the command line take precedence.
+type Config struct {
+	// SkipResources replaces DefaultSkipResources. See Arguments.SkipResources.
+	SkipResources []string `json:"skipResources,omitempty"`
+
+	// OnlyResources: only these resources get recorded. See Arguments.OnlyResources.
+	OnlyResources []string `json:"onlyResources,omitempty"`
+
+	// Selector and FieldSelector get used for all resources. See Arguments.LabelSelector.
+	Selector      string `json:"selector,omitempty"`
+	FieldSelector string `json:"fieldSelector,omitempty"`
+
+	// Selectors override Selector and FieldSelector for some resources. The first match wins.
+	Selectors []ResourceSelector `json:"selectors,omitempty"`
+
+	// IgnorePaths are ignored when comparing a version with the last stored version.
+	// See Arguments.IgnorePaths.
+	IgnorePaths []string `json:"ignorePaths,omitempty"`
+}
+
+// LoadConfig reads a YAML config file. Unknown fields are an error.
+func LoadConfig(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile() failed: %w", err)
+	}
+
+	var config Config
+
+	err = yaml.UnmarshalStrict(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q failed: %w", file, err)
+	}
+
+	return &config, nil
+}
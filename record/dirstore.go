@@ -0,0 +1,341 @@
+package record
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// DirStore is the default Store. It writes each version to its own file:
+// BASEDIR/GROUP/KIND/NAMESPACE/NAME/TIMESTAMP-SEQUENCE.yaml
+//
+// The log of each container instance gets appended to its own file in
+// LogsDir. See LogFileName. Gaps of the logs get written to their own files,
+// see LogGapFileName.
+//
+// If StoreOptions.KeyframeInterval is set, most versions get written as JSON
+// merge patch against the previous version (PatchSuffix). Use ReadVersion to
+// get the full object.
+type DirStore struct {
+	baseDir string
+	opts    StoreOptions
+
+	// pruneMu gets locked exclusively by Prune, and shared while writing.
+	pruneMu sync.RWMutex
+
+	mu sync.Mutex
+
+	// chains contains the last version of each object which was written since
+	// the last keyframe. Key is the directory of the object.
+	chains map[string]*patchChain
+
+	// logs contains the open log files.
+	logs map[ContainerRef]*logFile
+}
+
+// logFile is an open log file of a container instance.
+type logFile struct {
+	file   *os.File
+	writer writeCloseFlusher
+}
+
+func (f *logFile) close() error {
+	err := errors.Join(f.writer.Close(), f.file.Close())
+	if err != nil {
+		return fmt.Errorf("closing %q failed: %w", f.file.Name(), err)
+	}
+
+	return nil
+}
+
+// patchChain is the state of an object which gets stored as patches.
+type patchChain struct {
+	last map[string]any
+
+	// versions is the number of versions since the last keyframe, including the keyframe.
+	versions int
+}
+
+var (
+	_ Store  = &DirStore{}
+	_ Pruner = &DirStore{}
+)
+
+// NewDirStore creates a DirStore with default options which writes to
+// baseDir. It matches StoreFactory.
+func NewDirStore(baseDir string) (Store, error) {
+	return DirStoreFactory(StoreOptions{})(baseDir)
+}
+
+// DirStoreFactory returns a StoreFactory for DirStores with the given options.
+func DirStoreFactory(opts StoreOptions) StoreFactory {
+	return func(baseDir string) (Store, error) {
+		err := os.MkdirAll(baseDir, 0o700)
+		if err != nil {
+			return nil, fmt.Errorf("os.MkdirAll() failed: %w", err)
+		}
+
+		return &DirStore{
+			baseDir: baseDir,
+			opts:    opts,
+			chains:  make(map[string]*patchChain),
+			logs:    make(map[ContainerRef]*logFile),
+		}, nil
+	}
+}
+
+// StartSession writes the start marker. The deltas command uses it to find
+// the files of the last session.
+func (s *DirStore) StartSession(info SessionInfo) error {
+	return writeStartMarker(s.baseDir, info)
+}
+
+// EndSession closes the log files which are still open, and writes the end marker.
+func (s *DirStore) EndSession(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+
+	for ref, f := range s.logs {
+		errs = append(errs, f.close())
+		delete(s.logs, ref)
+	}
+
+	err := errors.Join(errs...)
+	if err != nil {
+		return err
+	}
+
+	return writeMarker(s.baseDir, EndMarkerPrefix, t, nil)
+}
+
+// PutVersion writes the object to a new file, and appends meta to the index
+// of the object.
+func (s *DirStore) PutVersion(ref ObjectRef, meta VersionMeta, obj *unstructured.Unstructured) error {
+	return s.put(ref, meta, obj, ".yaml")
+}
+
+// PutTombstone writes the object to a new file with TombstoneSuffix.
+func (s *DirStore) PutTombstone(ref ObjectRef, meta VersionMeta, obj *unstructured.Unstructured) error {
+	return s.put(ref, meta, obj, TombstoneSuffix)
+}
+
+func (s *DirStore) put(ref ObjectRef, meta VersionMeta, obj *unstructured.Unstructured, suffix string) error {
+	s.pruneMu.RLock()
+	defer s.pruneMu.RUnlock()
+
+	dir := filepath.Join(s.baseDir, ref.Group, ref.Kind, ref.Namespace, ref.Name)
+
+	bytes, suffix, err := s.encode(dir, obj, suffix)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		s.resetChain(dir)
+		return fmt.Errorf("os.MkdirAll() failed: %w", err)
+	}
+
+	meta.File = VersionFileName(meta.Observed, meta.Sequence, suffix+s.opts.suffix())
+
+	err = s.writeFile(filepath.Join(dir, meta.File), bytes)
+	if err != nil {
+		// The next patch would be based on a version which was not written.
+		s.resetChain(dir)
+		return err
+	}
+
+	return appendIndex(dir, meta, s.opts.Recipients)
+}
+
+// resetChain lets the next version of the object get written as keyframe.
+func (s *DirStore) resetChain(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.chains, dir)
+}
+
+// encode returns the content and the suffix of the file of a new version.
+// This is a merge patch if the object has a patch chain which is shorter than
+// the keyframe interval. Otherwise it is the YAML of the object.
+func (s *DirStore) encode(dir string, obj *unstructured.Unstructured, suffix string) ([]byte, string, error) {
+	if s.opts.KeyframeInterval > 0 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		chain := s.chains[dir]
+
+		switch {
+		case suffix == TombstoneSuffix:
+			// The next version after a tombstone is a new object.
+			delete(s.chains, dir)
+		case containsNull(obj.Object):
+			// Can't be expressed by a merge patch.
+			delete(s.chains, dir)
+		case chain != nil && chain.versions < s.opts.KeyframeInterval:
+			patch := createMergePatch(chain.last, obj.Object)
+
+			bytes, err := json.Marshal(patch)
+			if err != nil {
+				return nil, "", fmt.Errorf("json.Marshal(patch) failed: %w", err)
+			}
+
+			chain.last = obj.DeepCopy().Object
+			chain.versions++
+
+			return bytes, PatchSuffix, nil
+		default:
+			s.chains[dir] = &patchChain{last: obj.DeepCopy().Object, versions: 1}
+		}
+	}
+
+	bytes, err := yaml.Marshal(obj)
+	if err != nil {
+		return nil, "", fmt.Errorf("yaml.Marshal(obj) failed: %w", err)
+	}
+
+	return bytes, suffix, nil
+}
+
+// AppendLogLine appends the line to the log file of the container instance.
+// The first line creates the file.
+func (s *DirStore) AppendLogLine(line LogLine) error {
+	s.pruneMu.RLock()
+	defer s.pruneMu.RUnlock()
+
+	f, err := s.logFile(line)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(f.writer, line.String()+"\n")
+	if err != nil {
+		return fmt.Errorf("writing %q failed: %w", f.file.Name(), err)
+	}
+
+	// Flush each line, so that the file can be read while recording.
+	err = f.writer.Flush()
+	if err != nil {
+		return fmt.Errorf("writing %q failed: %w", f.file.Name(), err)
+	}
+
+	return nil
+}
+
+// logFile returns the open log file of the container instance of line, and
+// creates it if needed.
+func (s *DirStore) logFile(line LogLine) (*logFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, found := s.logs[line.ContainerRef]; found {
+		return f, nil
+	}
+
+	dir := filepath.Join(s.baseDir, LogsDir, line.Namespace, line.Pod)
+
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("os.MkdirAll() failed: %w", err)
+	}
+
+	name := filepath.Join(dir, LogFileName(line.Observed, line.Sequence, line.ContainerRef)+s.opts.suffix())
+
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("os.OpenFile() failed: %w", err)
+	}
+
+	w, err := s.opts.newWriter(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	f := &logFile{file: file, writer: w}
+	s.logs[line.ContainerRef] = f
+
+	return f, nil
+}
+
+// AppendLogGap writes the gap to a new file next to the log files of the pod.
+func (s *DirStore) AppendLogGap(gap LogGap) error {
+	s.pruneMu.RLock()
+	defer s.pruneMu.RUnlock()
+
+	data, err := json.Marshal(gap)
+	if err != nil {
+		return fmt.Errorf("json.Marshal() failed: %w", err)
+	}
+
+	dir := filepath.Join(s.baseDir, LogsDir, gap.Namespace, gap.Pod)
+
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("os.MkdirAll() failed: %w", err)
+	}
+
+	return s.writeFile(filepath.Join(dir, LogGapFileName(gap)+s.opts.suffix()), append(data, '\n'))
+}
+
+// CloseLog closes the log file of the container instance.
+func (s *DirStore) CloseLog(ref ContainerRef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, found := s.logs[ref]
+	if !found {
+		// The stream ended before the first line.
+		return nil
+	}
+
+	delete(s.logs, ref)
+
+	return f.close()
+}
+
+// Prune deletes old files according to the limits. See the package function Prune.
+func (s *DirStore) Prune(opts PruneOptions, now time.Time) (PruneResult, error) {
+	s.pruneMu.Lock()
+	defer s.pruneMu.Unlock()
+
+	if opts.Recipients == nil {
+		opts.Recipients = s.opts.Recipients
+	}
+
+	s.mu.Lock()
+	openFiles := make(map[string]bool, len(s.logs))
+
+	for _, f := range s.logs {
+		openFiles[f.file.Name()] = true
+	}
+	s.mu.Unlock()
+
+	return prune(s.baseDir, opts, now, openFiles)
+}
+
+// writeFile writes data to a new file, compressed and encrypted according to the options.
+func (s *DirStore) writeFile(file string, data []byte) error {
+	data, err := s.opts.encode(data)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(file, data, 0o600)
+	if err != nil {
+		return fmt.Errorf("os.WriteFile() failed: %w", err)
+	}
+
+	return nil
+}
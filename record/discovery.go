@@ -0,0 +1,176 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+)
+
+// rediscoveryDelay is the time to wait after a change of a CRD or APIService
+// before discovery runs again. A new CRD gets served some time after it was
+// created, and several changes usually arrive in a burst.
+const rediscoveryDelay = 2 * time.Second
+
+// apiChangeResources are watched to notice when resources get added or removed.
+var apiChangeResources = []schema.GroupVersionResource{
+	{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"},
+	{Group: "apiregistration.k8s.io", Version: "v1", Resource: "apiservices"},
+}
+
+// recorder keeps track of the resource watchers of one cluster.
+type recorder struct {
+	args            *Arguments
+	dynClient       *dynamic.DynamicClient
+	discoveryClient discovery.DiscoveryInterface
+	store           Store
+	wg              *sync.WaitGroup
+
+	mu       sync.Mutex
+	watchers map[schema.GroupVersionResource]context.CancelFunc
+}
+
+// discover fetches the resources served by the cluster. Watchers get started
+// for new resources, and watchers of resources which are no longer served get stopped.
+func (r *recorder) discover(ctx context.Context) error {
+	serverResources, err := r.discoveryClient.ServerPreferredResources()
+
+	var failed map[schema.GroupVersion]error
+
+	if err != nil {
+		var groupErr *discovery.ErrGroupDiscoveryFailed
+		if !errors.As(err, &groupErr) {
+			return fmt.Errorf("discoveryClient.ServerPreferredResources() failed: %w", err)
+		}
+
+		fmt.Printf("WARNING: The Kubernetes server has an orphaned API service. Server reports: %s\n", err.Error())
+		fmt.Printf("WARNING: To fix this, kubectl delete apiservice <service-name>\n")
+
+		failed = groupErr.Groups
+	}
+
+	r.syncWatchers(ctx, serverResources, failed)
+
+	return nil
+}
+
+func (r *recorder) syncWatchers(ctx context.Context, serverResources []*metav1.APIResourceList, failed map[schema.GroupVersion]error) {
+	desired := make(map[schema.GroupVersionResource]bool)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, resourceList := range serverResources {
+		groupVersion, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if err != nil {
+			fmt.Printf("Failed to parse group version: %v\n", err)
+			continue
+		}
+
+		for i := range resourceList.APIResources {
+			resourceName := resourceList.APIResources[i].Name
+			if r.args.skipResource(groupVersion.Group, resourceName) {
+				continue
+			}
+
+			namespaced := resourceList.APIResources[i].Namespaced
+			if !namespaced && r.args.SkipClusterScoped && r.args.namespaceFilterActive() {
+				continue
+			}
+
+			gvr := groupVersion.WithResource(resourceName)
+			desired[gvr] = true
+
+			if _, found := r.watchers[gvr]; found {
+				continue
+			}
+
+			watchCtx, cancel := context.WithCancel(ctx)
+			r.watchers[gvr] = cancel
+
+			r.wg.Add(1)
+			go watchGVR(watchCtx, r.wg, r.args, r.dynClient, gvr, r.store, namespaced)
+		}
+	}
+
+	for gvr, cancel := range r.watchers {
+		if desired[gvr] {
+			continue
+		}
+
+		// Discovery of this group failed. It is unknown whether the resource
+		// still exists, so keep the watcher.
+		if _, found := failed[gvr.GroupVersion()]; found {
+			continue
+		}
+
+		fmt.Printf("Stop watching %q %q, the resource is no longer served\n", gvr.Group, gvr.Resource)
+		cancel()
+		delete(r.watchers, gvr)
+	}
+}
+
+// watchAPIChanges starts goroutines which run discovery again whenever a
+// CustomResourceDefinition or an APIService changes.
+func (r *recorder) watchAPIChanges(ctx context.Context) {
+	trigger := make(chan struct{}, 1)
+
+	for _, gvr := range apiChangeResources {
+		// No selectors: changes of all CRDs and APIServices are relevant.
+		w := newGVRWatcher(r.dynClient, gvr, metav1.NamespaceAll, metav1.ListOptions{}, func(_ watch.Event, initialList bool) error {
+			if initialList {
+				return nil
+			}
+
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+
+			return nil
+		})
+
+		r.wg.Add(1)
+
+		go func() {
+			defer r.wg.Done()
+			w.run(ctx)
+		}()
+	}
+
+	r.wg.Add(1)
+
+	go func() {
+		defer r.wg.Done()
+
+		for {
+			select {
+			case <-trigger:
+			case <-ctx.Done():
+				return
+			}
+
+			if !sleepWithContext(ctx, rediscoveryDelay) {
+				return
+			}
+
+			// Changes which arrived while waiting are covered by this discovery.
+			select {
+			case <-trigger:
+			default:
+			}
+
+			err := r.discover(ctx)
+			if err != nil {
+				fmt.Printf("Error running discovery: %v\n", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,219 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+)
+
+// EncryptionSuffix gets appended to the names of encrypted files, after the
+// suffix of the compression.
+const EncryptionSuffix = ".age"
+
+// ErrNoIdentity gets returned when reading an encrypted file without a
+// matching identity. See SetIdentities.
+var ErrNoIdentity = errors.New("no matching identity to decrypt the file")
+
+// errNoRecipient gets returned when a file should be encrypted again, but
+// no recipient is known.
+var errNoRecipient = errors.New("no recipient to encrypt the file")
+
+var (
+	identitiesMu sync.RWMutex
+	identities   []age.Identity
+)
+
+// SetIdentities sets the identities which get used by OpenFile and ReadFile
+// to decrypt files with EncryptionSuffix.
+func SetIdentities(ids []age.Identity) {
+	identitiesMu.Lock()
+	defer identitiesMu.Unlock()
+
+	identities = ids
+}
+
+func getIdentities() []age.Identity {
+	identitiesMu.RLock()
+	defer identitiesMu.RUnlock()
+
+	return identities
+}
+
+// recipientsOfIdentities returns the recipients of the X25519 identities
+// given by SetIdentities.
+func recipientsOfIdentities() []age.Recipient {
+	var recipients []age.Recipient
+
+	for _, id := range getIdentities() {
+		if x, ok := id.(*age.X25519Identity); ok {
+			recipients = append(recipients, x.Recipient())
+		}
+	}
+
+	return recipients
+}
+
+// LoadRecipients parses age recipients (public keys like "age1..."). Each
+// entry is a recipient, or the name of a file with one recipient per line.
+func LoadRecipients(values []string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+
+	for _, value := range values {
+		if strings.HasPrefix(value, "age1") {
+			r, err := age.ParseX25519Recipient(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid recipient %q: %w", value, err)
+			}
+
+			recipients = append(recipients, r)
+
+			continue
+		}
+
+		f, err := os.Open(value)
+		if err != nil {
+			return nil, fmt.Errorf("os.Open() failed: %w", err)
+		}
+
+		r, err := age.ParseRecipients(f)
+		f.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("parsing recipients of %q failed: %w", value, err)
+		}
+
+		recipients = append(recipients, r...)
+	}
+
+	return recipients, nil
+}
+
+// LoadIdentities reads age identity files, like the ones created by age-keygen.
+func LoadIdentities(files []string) ([]age.Identity, error) {
+	var ids []age.Identity
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("os.Open() failed: %w", err)
+		}
+
+		fileIDs, err := age.ParseIdentities(f)
+		f.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("parsing identities of %q failed: %w", file, err)
+		}
+
+		ids = append(ids, fileIDs...)
+	}
+
+	return ids, nil
+}
+
+// IsEncrypted returns true if the name has EncryptionSuffix.
+func IsEncrypted(name string) bool {
+	return strings.HasSuffix(name, EncryptionSuffix)
+}
+
+// suffix returns the suffix of stored files: compression, then encryption.
+func (o StoreOptions) suffix() string {
+	if len(o.Recipients) == 0 {
+		return o.Compression.Suffix()
+	}
+
+	return o.Compression.Suffix() + EncryptionSuffix
+}
+
+// encode returns data compressed and encrypted according to the options.
+func (o StoreOptions) encode(data []byte) ([]byte, error) {
+	return encode(data, o.Compression, o.Recipients)
+}
+
+func encode(data []byte, compression Compression, recipients []age.Recipient) ([]byte, error) {
+	data, err := compression.compress(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(recipients) == 0 {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("age.Encrypt() failed: %w", err)
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting failed: %w", err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("encrypting failed: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// newWriter returns a writer which compresses and encrypts to w. Closing it
+// does not close w.
+//
+// Flush writes all compressed data to the encryption. The encryption writes
+// chunks of 64 KiB, so up to one chunk gets lost if the process gets killed.
+func (o StoreOptions) newWriter(w io.Writer) (writeCloseFlusher, error) {
+	if len(o.Recipients) == 0 {
+		return o.Compression.newWriter(w)
+	}
+
+	encrypter, err := age.Encrypt(w, o.Recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("age.Encrypt() failed: %w", err)
+	}
+
+	compressor, err := o.Compression.newWriter(encrypter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptingWriter{writeCloseFlusher: compressor, encrypter: encrypter}, nil
+}
+
+type encryptingWriter struct {
+	writeCloseFlusher
+	encrypter io.WriteCloser
+}
+
+func (w *encryptingWriter) Close() error {
+	return errors.Join(w.writeCloseFlusher.Close(), w.encrypter.Close())
+}
+
+// decrypt returns a reader of the plaintext of r.
+func decrypt(name string, r io.Reader) (io.Reader, error) {
+	ids := getIdentities()
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%q is encrypted: %w", name, ErrNoIdentity)
+	}
+
+	plain, err := age.Decrypt(r, ids...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return nil, fmt.Errorf("%q: %w", name, ErrNoIdentity)
+		}
+
+		return nil, fmt.Errorf("age.Decrypt() failed %q: %w", name, err)
+	}
+
+	return plain, nil
+}
@@ -0,0 +1,56 @@
+package record
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sequence numbers all stored versions and log lines of this process. It
+// provides a total order, even if several files get created within one tick
+// of TimeFormat.
+var sequence atomic.Uint64
+
+func nextSequence() uint64 {
+	return sequence.Add(1)
+}
+
+// VersionFileName returns the basename of a stored version:
+// TIMESTAMP-SEQUENCE.SUFFIX, for example 20250227-152147.59958-0000000042.yaml.
+func VersionFileName(observed time.Time, seq uint64, suffix string) string {
+	return fmt.Sprintf("%s-%010d%s", observed.UTC().Format(TimeFormat), seq, suffix)
+}
+
+// ParseVersionFileName returns the timestamp, the sequence number and the
+// suffix of a basename created by VersionFileName. Files of older recordings
+// have no sequence number. For these zero gets returned.
+func ParseVersionFileName(baseName string) (time.Time, uint64, string, error) {
+	if len(baseName) < len(TimeFormat) {
+		return time.Time{}, 0, "", fmt.Errorf("file name %q is too short", baseName)
+	}
+
+	t, err := time.Parse(TimeFormat, baseName[:len(TimeFormat)])
+	if err != nil {
+		return time.Time{}, 0, "", fmt.Errorf("time.Parse() format=%s failed: %w", TimeFormat, err)
+	}
+
+	rest := baseName[len(TimeFormat):]
+
+	if !strings.HasPrefix(rest, "-") {
+		return t, 0, rest, nil
+	}
+
+	digits, suffix, found := strings.Cut(rest[1:], ".")
+	if found {
+		suffix = "." + suffix
+	}
+
+	seq, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, "", fmt.Errorf("invalid sequence number in %q: %w", baseName, err)
+	}
+
+	return t, seq, suffix, nil
+}
@@ -0,0 +1,257 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"filippo.io/age"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// IndexFile is the name of the file in each object directory which contains
+// one VersionMeta (JSON) per line. In encrypted recordings each line is an
+// encryptedIndexLine.
+const IndexFile = "index.jsonl"
+
+// VersionMeta describes how a stored version of an object was observed.
+type VersionMeta struct {
+	// File is the basename of the stored version.
+	File string `json:"file"`
+
+	// EventType is the type of the watch event: ADDED, MODIFIED or DELETED.
+	EventType watch.EventType `json:"eventType"`
+
+	ResourceVersion string `json:"resourceVersion"`
+	UID             string `json:"uid"`
+
+	// InitialList is true if the object was part of the List at the start of the recording.
+	InitialList bool `json:"initialList,omitempty"`
+
+	// Sequence orders all versions and log lines of a recording session.
+	Sequence uint64 `json:"sequence"`
+
+	// Observed is the time the recorder received the object.
+	Observed time.Time `json:"observed"`
+}
+
+// encryptedIndexLine is a line of the index of an encrypted recording. Only
+// the basename of the version is not encrypted. It is visible in the
+// directory anyway.
+type encryptedIndexLine struct {
+	File string `json:"file"`
+
+	// Meta is the age encrypted JSON of the VersionMeta.
+	Meta []byte `json:"meta"`
+}
+
+// appendIndex appends meta to the index of dir. If there are recipients, meta
+// gets encrypted.
+func appendIndex(dir string, meta VersionMeta, recipients []age.Recipient) error {
+	line, err := marshalIndexLine(meta, recipients)
+	if err != nil {
+		return err
+	}
+
+	file := filepath.Join(dir, IndexFile)
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile() failed: %w", err)
+	}
+
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("writing %q failed: %w", file, err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("closing %q failed: %w", file, err)
+	}
+
+	return nil
+}
+
+func marshalIndexLine(meta VersionMeta, recipients []age.Recipient) ([]byte, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal() failed: %w", err)
+	}
+
+	if len(recipients) == 0 {
+		return data, nil
+	}
+
+	encrypted, err := encode(data, CompressionNone, recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = json.Marshal(encryptedIndexLine{File: meta.File, Meta: encrypted})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal() failed: %w", err)
+	}
+
+	return data, nil
+}
+
+// unmarshalIndexLine parses a line of the index. Encrypted lines get
+// decrypted, see SetIdentities.
+func unmarshalIndexLine(file string, line []byte) (VersionMeta, error) {
+	var (
+		meta      VersionMeta
+		encrypted encryptedIndexLine
+	)
+
+	err := json.Unmarshal(line, &encrypted)
+	if err != nil {
+		return meta, fmt.Errorf("invalid line in %q: %w", file, err)
+	}
+
+	if encrypted.Meta == nil {
+		err = json.Unmarshal(line, &meta)
+		if err != nil {
+			return meta, fmt.Errorf("invalid line in %q: %w", file, err)
+		}
+
+		return meta, nil
+	}
+
+	r, err := decrypt(file, bytes.NewReader(encrypted.Meta))
+	if err != nil {
+		return meta, err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return meta, fmt.Errorf("decrypting %q failed: %w", file, err)
+	}
+
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return meta, fmt.Errorf("invalid line in %q: %w", file, err)
+	}
+
+	// The file might have been renamed by Prune.
+	meta.File = encrypted.File
+
+	return meta, nil
+}
+
+// ReadIndex reads the index of an object directory. The key of the result is
+// the basename of the stored version. Recordings of older versions have no
+// index. In this case an empty map gets returned.
+func ReadIndex(dir string) (map[string]VersionMeta, error) {
+	result := make(map[string]VersionMeta)
+
+	f, err := os.Open(filepath.Join(dir, IndexFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return result, nil
+		}
+
+		return nil, fmt.Errorf("os.Open() failed: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		meta, err := unmarshalIndexLine(f.Name(), scanner.Bytes())
+		if err != nil {
+			return nil, err
+		}
+
+		result[meta.File] = meta
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading %q failed: %w", f.Name(), err)
+	}
+
+	return result, nil
+}
+
+// rewriteIndex removes the entries of deleted files from the index of an
+// object directory, and renames entries according to renamed. Encrypted
+// entries don't need to be decrypted for this.
+func rewriteIndex(dir string, deleted map[string]bool, renamed map[string]string) error {
+	file := filepath.Join(dir, IndexFile)
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("os.ReadFile() failed: %w", err)
+	}
+
+	var buf bytes.Buffer
+
+	for line := range bytes.Lines(data) {
+		var encrypted encryptedIndexLine
+
+		err := json.Unmarshal(line, &encrypted)
+		if err != nil {
+			return fmt.Errorf("invalid line in %q: %w", file, err)
+		}
+
+		if deleted[encrypted.File] {
+			continue
+		}
+
+		newName, found := renamed[encrypted.File]
+		if !found {
+			buf.Write(line)
+			continue
+		}
+
+		var newLine []byte
+
+		if encrypted.Meta != nil {
+			encrypted.File = newName
+
+			newLine, err = json.Marshal(encrypted)
+		} else {
+			var meta VersionMeta
+
+			err = json.Unmarshal(line, &meta)
+			if err != nil {
+				return fmt.Errorf("invalid line in %q: %w", file, err)
+			}
+
+			meta.File = newName
+
+			newLine, err = json.Marshal(meta)
+		}
+
+		if err != nil {
+			return fmt.Errorf("json.Marshal() failed: %w", err)
+		}
+
+		buf.Write(append(newLine, '\n'))
+	}
+
+	tmp := file + ".tmp"
+
+	err = os.WriteFile(tmp, buf.Bytes(), 0o600)
+	if err != nil {
+		return fmt.Errorf("os.WriteFile() failed: %w", err)
+	}
+
+	err = os.Rename(tmp, file)
+	if err != nil {
+		return fmt.Errorf("os.Rename() failed: %w", err)
+	}
+
+	return nil
+}
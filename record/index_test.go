@@ -0,0 +1,72 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+func TestEncryptedIndex(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	baseDir := t.TempDir()
+	opts := StoreOptions{KeyframeInterval: 20, Recipients: []age.Recipient{id.Recipient()}}
+	start := time.Date(2025, 2, 27, 15, 0, 0, 0, time.UTC)
+
+	names := recordTestSession(t, baseDir, opts, "first", start, 6)
+	dir := objectDir(baseDir)
+
+	data, err := os.ReadFile(filepath.Join(dir, IndexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(data, []byte("resourceVersion")) {
+		t.Errorf("the index is not encrypted:\n%s", data)
+	}
+
+	_, err = ReadIndex(dir)
+	if !errors.Is(err, ErrNoIdentity) {
+		t.Errorf("got error %v, want ErrNoIdentity", err)
+	}
+
+	SetIdentities([]age.Identity{id})
+	t.Cleanup(func() { SetIdentities(nil) })
+
+	// Version 4 gets materialized, so its entry gets renamed.
+	_, err = Prune(baseDir, PruneOptions{MaxVersionsPerObject: 4}, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := ReadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(index) != 4 {
+		t.Errorf("the index has %d entries, want 4", len(index))
+	}
+
+	for _, i := range []int{1, 4, 5, 6} {
+		name := findVersionFile(t, dir, names[i-1])
+
+		meta, found := index[name]
+		if !found {
+			t.Errorf("the index does not contain %q", name)
+			continue
+		}
+
+		if meta.Sequence != uint64(i) || meta.File != name {
+			t.Errorf("%q: got sequence %d and file %q", name, meta.Sequence, meta.File)
+		}
+	}
+}
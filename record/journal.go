@@ -0,0 +1,394 @@
+package record
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	// JournalPrefix is the prefix of the segment files of a JournalStore:
+	// journal-SESSIONSTART-SEGMENT.jsonl
+	JournalPrefix = "journal-"
+
+	// JournalLogType is the type of journal entries which contain a log line.
+	JournalLogType = "LOG"
+
+	// JournalLogGapType is the type of journal entries which contain a LogGap.
+	JournalLogGapType = "LOG_GAP"
+
+	// DefaultJournalSegmentSize is the size after which a new segment gets started.
+	DefaultJournalSegmentSize = 64 * 1024 * 1024
+)
+
+// JournalEntry is one line of a journal segment. It contains either a
+// version of an object, a log line (Type is JournalLogType) or a gap of a log
+// (Type is JournalLogGapType). For log lines and gaps Namespace, Name and UID
+// are the ones of the pod.
+type JournalEntry struct {
+	// Type is the watch event type (ADDED, MODIFIED, DELETED), JournalLogType
+	// or JournalLogGapType.
+	Type string `json:"type"`
+
+	Sequence uint64    `json:"sequence"`
+	Observed time.Time `json:"observed"`
+
+	Group      string `json:"group,omitempty"`
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name,omitempty"`
+
+	ResourceVersion string          `json:"resourceVersion,omitempty"`
+	UID             string          `json:"uid,omitempty"`
+	InitialList     bool            `json:"initialList,omitempty"`
+	Object          json.RawMessage `json:"object,omitempty"`
+
+	Container    string    `json:"container,omitempty"`
+	RestartCount int32     `json:"restartCount,omitempty"`
+	Timestamp    time.Time `json:"timestamp,omitzero"`
+	Line         string    `json:"line,omitempty"`
+
+	GapFrom   time.Time `json:"gapFrom,omitzero"`
+	GapTo     time.Time `json:"gapTo,omitzero"`
+	GapReason string    `json:"gapReason,omitempty"`
+}
+
+// LogLine returns the log line of an entry of JournalLogType.
+func (e *JournalEntry) LogLine() LogLine {
+	return LogLine{
+		ContainerRef: ContainerRef{
+			Namespace:    e.Namespace,
+			Pod:          e.Name,
+			PodUID:       e.UID,
+			Container:    e.Container,
+			RestartCount: e.RestartCount,
+		},
+		Sequence:  e.Sequence,
+		Observed:  e.Observed,
+		Timestamp: e.Timestamp,
+		Line:      e.Line,
+	}
+}
+
+// LogGap returns the gap of an entry of JournalLogGapType.
+func (e *JournalEntry) LogGap() LogGap {
+	return LogGap{
+		ContainerRef: e.LogLine().ContainerRef,
+		Sequence:     e.Sequence,
+		Observed:     e.Observed,
+		From:         e.GapFrom,
+		To:           e.GapTo,
+		Reason:       e.GapReason,
+	}
+}
+
+// Path returns the path the entry would have in the layout of DirStore,
+// relative to the directory of the cluster. For log lines this is the path of
+// a log file which starts with the line.
+func (e *JournalEntry) Path() string {
+	switch e.Type {
+	case JournalLogType:
+		line := e.LogLine()
+		return filepath.Join(LogsDir, e.Namespace, e.Name, LogFileName(e.Observed, e.Sequence, line.ContainerRef))
+	case JournalLogGapType:
+		return filepath.Join(LogsDir, e.Namespace, e.Name, LogGapFileName(e.LogGap()))
+	}
+
+	suffix := ".yaml"
+	if e.Type == string(watch.Deleted) {
+		suffix = TombstoneSuffix
+	}
+
+	return filepath.Join(e.Group, e.Kind, e.Namespace, e.Name,
+		VersionFileName(e.Observed, e.Sequence, suffix))
+}
+
+// JournalStore appends all versions and log lines to JSONL segment files in
+// the directory of the cluster. This avoids creating one file per version.
+type JournalStore struct {
+	baseDir        string
+	maxSegmentSize int64
+	opts           StoreOptions
+
+	mu           sync.Mutex
+	sessionStart string
+	segment      int
+	file         *os.File
+	writer       writeCloseFlusher
+
+	// size is the uncompressed size of the current segment.
+	size int64
+}
+
+var _ Store = &JournalStore{}
+
+// JournalStoreFactory returns a StoreFactory for JournalStores. A new
+// segment gets started when a segment is bigger than maxSegmentSize. Zero
+// means DefaultJournalSegmentSize.
+func JournalStoreFactory(maxSegmentSize int64, opts StoreOptions) StoreFactory {
+	if maxSegmentSize <= 0 {
+		maxSegmentSize = DefaultJournalSegmentSize
+	}
+
+	return func(baseDir string) (Store, error) {
+		err := os.MkdirAll(baseDir, 0o700)
+		if err != nil {
+			return nil, fmt.Errorf("os.MkdirAll() failed: %w", err)
+		}
+
+		return &JournalStore{
+			baseDir:        baseDir,
+			maxSegmentSize: maxSegmentSize,
+			opts:           opts,
+		}, nil
+	}
+}
+
+// StartSession writes the start marker. The segments of the session get the
+// timestamp of the marker.
+func (s *JournalStore) StartSession(info SessionInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessionStart = info.Start.UTC().Format(TimeFormat)
+
+	return writeStartMarker(s.baseDir, info)
+}
+
+// EndSession closes the current segment and writes the end marker.
+func (s *JournalStore) EndSession(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.closeSegment()
+	if err != nil {
+		return err
+	}
+
+	return writeMarker(s.baseDir, EndMarkerPrefix, t, nil)
+}
+
+// PutVersion appends the object to the journal.
+func (s *JournalStore) PutVersion(ref ObjectRef, meta VersionMeta, obj *unstructured.Unstructured) error {
+	return s.putObject(ref, meta, obj)
+}
+
+// PutTombstone appends the last known state of a deleted object to the journal.
+func (s *JournalStore) PutTombstone(ref ObjectRef, meta VersionMeta, obj *unstructured.Unstructured) error {
+	return s.putObject(ref, meta, obj)
+}
+
+func (s *JournalStore) putObject(ref ObjectRef, meta VersionMeta, obj *unstructured.Unstructured) error {
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("obj.MarshalJSON() failed: %w", err)
+	}
+
+	return s.append(&JournalEntry{
+		Type:            string(meta.EventType),
+		Sequence:        meta.Sequence,
+		Observed:        meta.Observed,
+		Group:           ref.Group,
+		APIVersion:      obj.GetAPIVersion(),
+		Kind:            ref.Kind,
+		Namespace:       ref.Namespace,
+		Name:            ref.Name,
+		ResourceVersion: meta.ResourceVersion,
+		UID:             meta.UID,
+		InitialList:     meta.InitialList,
+		Object:          data,
+	})
+}
+
+// AppendLogLine appends the log line to the journal.
+func (s *JournalStore) AppendLogLine(line LogLine) error {
+	return s.append(&JournalEntry{
+		Type:         JournalLogType,
+		Sequence:     line.Sequence,
+		Observed:     line.Observed,
+		Namespace:    line.Namespace,
+		Name:         line.Pod,
+		UID:          line.PodUID,
+		Container:    line.Container,
+		RestartCount: line.RestartCount,
+		Timestamp:    line.Timestamp,
+		Line:         line.Line,
+	})
+}
+
+// AppendLogGap appends the gap to the journal.
+func (s *JournalStore) AppendLogGap(gap LogGap) error {
+	return s.append(&JournalEntry{
+		Type:         JournalLogGapType,
+		Sequence:     gap.Sequence,
+		Observed:     gap.Observed,
+		Namespace:    gap.Namespace,
+		Name:         gap.Pod,
+		UID:          gap.PodUID,
+		Container:    gap.Container,
+		RestartCount: gap.RestartCount,
+		GapFrom:      gap.From,
+		GapTo:        gap.To,
+		GapReason:    gap.Reason,
+	})
+}
+
+// CloseLog does nothing. Log lines get appended to the journal.
+func (s *JournalStore) CloseLog(ContainerRef) error {
+	return nil
+}
+
+func (s *JournalStore) append(entry *JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("json.Marshal() failed: %w", err)
+	}
+
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil || s.size+int64(len(data)) > s.maxSegmentSize {
+		err := s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.writer.Write(data)
+	s.size += int64(n)
+
+	if err != nil {
+		return fmt.Errorf("writing %q failed: %w", s.file.Name(), err)
+	}
+
+	// Flush each entry, so that not much gets lost if the process gets killed.
+	err = s.writer.Flush()
+	if err != nil {
+		return fmt.Errorf("writing %q failed: %w", s.file.Name(), err)
+	}
+
+	return nil
+}
+
+// rotate closes the current segment and opens the next one.
+func (s *JournalStore) rotate() error {
+	err := s.closeSegment()
+	if err != nil {
+		return err
+	}
+
+	s.segment++
+	name := filepath.Join(s.baseDir, fmt.Sprintf("%s%s-%06d.jsonl%s", JournalPrefix, s.sessionStart, s.segment,
+		s.opts.suffix()))
+
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile() failed: %w", err)
+	}
+
+	w, err := s.opts.newWriter(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file = f
+	s.writer = w
+	s.size = 0
+
+	return nil
+}
+
+func (s *JournalStore) closeSegment() error {
+	if s.file == nil {
+		return nil
+	}
+
+	err := errors.Join(s.writer.Close(), s.file.Close())
+	if err != nil {
+		return fmt.Errorf("closing %q failed: %w", s.file.Name(), err)
+	}
+
+	s.file = nil
+	s.writer = nil
+
+	return nil
+}
+
+// ReadJournal returns the journal entries of the session which started at
+// sessionStart (in TimeFormat), ordered by sequence number. If the session
+// was not recorded with a JournalStore, no entries get returned.
+func ReadJournal(baseDir, sessionStart string) ([]JournalEntry, error) {
+	segments, err := filepath.Glob(filepath.Join(baseDir, JournalPrefix+sessionStart+"-*.jsonl*"))
+	if err != nil {
+		return nil, fmt.Errorf("filepath.Glob() failed: %w", err)
+	}
+
+	slices.Sort(segments)
+
+	var entries []JournalEntry
+
+	for _, segment := range segments {
+		entries, err = readJournalSegment(segment, entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Concurrent writers may append entries slightly out of order.
+	slices.SortStableFunc(entries, func(a, b JournalEntry) int {
+		switch {
+		case a.Sequence < b.Sequence:
+			return -1
+		case a.Sequence > b.Sequence:
+			return 1
+		}
+
+		return 0
+	})
+
+	return entries, nil
+}
+
+func readJournalSegment(segment string, entries []JournalEntry) ([]JournalEntry, error) {
+	f, err := OpenFile(segment)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	truncated, err := readLines(f, func(line []byte) error {
+		var entry JournalEntry
+
+		err := json.Unmarshal(line, &entry)
+		if err != nil {
+			return fmt.Errorf("invalid line in %q: %w", segment, err)
+		}
+
+		entries = append(entries, entry)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading %q failed: %w", segment, err)
+	}
+
+	if truncated {
+		// The segment was not closed, because the recorder was killed. All
+		// complete entries were read.
+		fmt.Printf("WARNING: %q is truncated\n", segment)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,89 @@
+package record
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+// TestReadJournalOfKilledRecorder reads a journal without EndSession, like it
+// is left by a killed recorder.
+func TestReadJournalOfKilledRecorder(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetIdentities([]age.Identity{id})
+	t.Cleanup(func() { SetIdentities(nil) })
+
+	// The lines compress badly, so the compressed journal is much bigger than
+	// one chunk of the encryption.
+	const lines = 5000
+
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		for _, encrypted := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s-encrypted=%v", compression, encrypted), func(t *testing.T) {
+				opts := StoreOptions{Compression: compression}
+				if encrypted {
+					opts.Recipients = []age.Recipient{id.Recipient()}
+				}
+
+				baseDir := t.TempDir()
+
+				store, err := JournalStoreFactory(0, opts)(baseDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				start := time.Date(2025, 2, 27, 15, 0, 0, 0, time.UTC)
+
+				err = store.StartSession(SessionInfo{Start: start})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for i := range lines {
+					err := store.AppendLogLine(LogLine{
+						ContainerRef: ContainerRef{Namespace: "default", Pod: "pod", Container: "app"},
+						Sequence:     uint64(i + 1),
+						Observed:     start,
+						Line:         testLogLine(i),
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				entries, err := ReadJournal(baseDir, start.Format(TimeFormat))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// The encryption writes chunks of 64 KiB. The last chunk is
+				// lost.
+				switch {
+				case !encrypted && len(entries) != lines:
+					t.Errorf("got %d entries, want %d", len(entries), lines)
+				case encrypted && len(entries) < lines/2:
+					t.Errorf("got only %d of %d entries", len(entries), lines)
+				}
+
+				for i, entry := range entries {
+					if want := testLogLine(i); entry.Line != want {
+						t.Fatalf("entry %d: got %q, want %q", i, entry.Line, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+// testLogLine returns a log line which can't be compressed much.
+func testLogLine(i int) string {
+	return fmt.Sprintf("line %d %x", i, sha256.Sum256([]byte(strconv.Itoa(i))))
+}
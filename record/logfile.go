@@ -0,0 +1,127 @@
+package record
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// LogsDir is the directory of the log files of DirStore, below the
+	// directory of the cluster:
+	// LOGSDIR/NAMESPACE/POD/TIMESTAMP-SEQUENCE.CONTAINER.RESTARTCOUNT.log
+	LogsDir = "logs"
+
+	// LogSuffix is the suffix of log files.
+	LogSuffix = ".log"
+
+	// LogGapSuffix is the suffix of the files which contain a LogGap (JSON).
+	LogGapSuffix = ".gap.json"
+)
+
+// LogFileName returns the basename of the log file of a container instance.
+// observed and seq are the ones of the first line.
+func LogFileName(observed time.Time, seq uint64, ref ContainerRef) string {
+	return VersionFileName(observed, seq, fmt.Sprintf(".%s.%d%s", ref.Container, ref.RestartCount, LogSuffix))
+}
+
+// LogGapFileName returns the basename of the file of a LogGap.
+func LogGapFileName(gap LogGap) string {
+	return VersionFileName(gap.Observed, gap.Sequence, fmt.Sprintf(".%s.%d%s", gap.Container, gap.RestartCount, LogGapSuffix))
+}
+
+// IsLogGapFile returns true if name is the name of a file of a LogGap, possibly compressed.
+func IsLogGapFile(name string) bool {
+	return strings.HasSuffix(TrimCompressionSuffix(name), LogGapSuffix)
+}
+
+// IsLogFile returns true if name is the name of a log file, possibly compressed.
+// Recordings of older versions contain one log file per line.
+func IsLogFile(name string) bool {
+	return strings.HasSuffix(TrimCompressionSuffix(name), LogSuffix)
+}
+
+// String returns the line like `kubectl logs --timestamps` shows it. Lines
+// without Timestamp get Observed.
+func (l LogLine) String() string {
+	t := l.Timestamp
+	if t.IsZero() {
+		t = l.Observed
+	}
+
+	return t.UTC().Format(time.RFC3339Nano) + " " + l.Line
+}
+
+// String describes the gap.
+func (g LogGap) String() string {
+	to := "the end of the stream"
+	if !g.To.IsZero() {
+		to = g.To.UTC().Format(time.RFC3339Nano)
+	}
+
+	return fmt.Sprintf("Lines of container %s (restart count %d) between %s and %s may be missing: %s",
+		g.Container, g.RestartCount, g.From.UTC().Format(time.RFC3339Nano), to, g.Reason)
+}
+
+// splitLogTimestamp splits the timestamp which gets added by
+// PodLogOptions.Timestamps from a line. If the line has no timestamp, the zero
+// time and the unchanged line get returned.
+func splitLogTimestamp(s string) (time.Time, string) {
+	prefix, line, found := strings.Cut(s, " ")
+	if !found {
+		return time.Time{}, s
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, prefix)
+	if err != nil {
+		return time.Time{}, s
+	}
+
+	return t, line
+}
+
+// ReadLogFile reads a log file. Only Timestamp and Line of the result are
+// set. Timestamp is zero for lines without timestamp, like the lines of older
+// recordings.
+//
+// Log files get appended while recording. A file which was not closed yet
+// gets read up to the last complete line.
+func ReadLogFile(file string) ([]LogLine, error) {
+	f, err := OpenFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []LogLine
+
+	_, err = readLines(f, func(data []byte) error {
+		t, line := splitLogTimestamp(string(data))
+		lines = append(lines, LogLine{Timestamp: t, Line: line})
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading %q failed: %w", file, err)
+	}
+
+	return lines, nil
+}
+
+// ReadLogGap reads a file written for a LogGap.
+func ReadLogGap(file string) (LogGap, error) {
+	var gap LogGap
+
+	data, err := ReadFile(file)
+	if err != nil {
+		return gap, err
+	}
+
+	err = json.Unmarshal(data, &gap)
+	if err != nil {
+		return gap, fmt.Errorf("invalid log gap in %q: %w", file, err)
+	}
+
+	return gap, nil
+}
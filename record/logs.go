@@ -0,0 +1,588 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// logScraper streams the logs of all containers, including init containers
+// and ephemeral containers. It watches the pods, so containers which start
+// while recording get streamed, too.
+type logScraper struct {
+	ctx       context.Context
+	wg        *sync.WaitGroup
+	clientset *kubernetes.Clientset
+	args      *Arguments
+	store     Store
+
+	// sessionStart: older log lines are not recorded.
+	sessionStart time.Time
+
+	mu sync.Mutex
+
+	// streams contains the log streams of the container instances. Key is
+	// the container ID, which is different for each instance.
+	streams map[string]*logStream
+}
+
+// logStream reads the log of a container instance.
+type logStream struct {
+	ref         ContainerRef
+	containerID string
+	ignoreLines []*regexp.Regexp
+	cancel      context.CancelFunc
+
+	// done gets closed when the stream ended.
+	done chan struct{}
+
+	// previousRead is true if the log of the terminated instance was read with
+	// PodLogOptions.Previous. This preserves the last lines of a crashed
+	// container, which the stream might not have received.
+	previousRead bool
+
+	// last is the timestamp of the last line which was read, lastCount the
+	// number of lines with this timestamp. A reconnected stream starts at
+	// last, these lines get skipped.
+	last      time.Time
+	lastCount int
+
+	// readers is the number of goroutines which read the log: the stream, and
+	// the read of the terminated instance. The last one closes the log.
+	// Guarded by logScraper.mu.
+	readers int
+}
+
+func createLogScraper(ctx context.Context, wg *sync.WaitGroup, clientset *kubernetes.Clientset,
+	dynClient *dynamic.DynamicClient, args Arguments, store Store, sessionStart time.Time,
+) {
+	s := &logScraper{
+		ctx:          ctx,
+		wg:           wg,
+		clientset:    clientset,
+		args:         &args,
+		store:        store,
+		sessionStart: sessionStart,
+		streams:      make(map[string]*logStream),
+	}
+
+	gvr := corev1.SchemeGroupVersion.WithResource("pods")
+	listOptions := args.listOptions("", "pods")
+
+	for _, namespace := range args.namespacesToList() {
+		w := newGVRWatcher(dynClient, gvr, namespace, listOptions, s.onPodEvent)
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			w.run(ctx)
+		}()
+	}
+}
+
+// onPodEvent starts a stream for each container instance which has no stream
+// yet. If a container instance terminated, and a new one was started, the log
+// of the terminated instance gets read again. The streams of deleted pods get
+// stopped.
+func (s *logScraper) onPodEvent(event watch.Event, _ bool) error {
+	obj, ok := event.Object.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("internal Error, could not cast to Unstructered %T", event.Object)
+	}
+
+	var pod corev1.Pod
+
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &pod)
+	if err != nil {
+		return fmt.Errorf("converting pod %s/%s failed: %w", obj.GetNamespace(), obj.GetName(), err)
+	}
+
+	if !s.args.NamespaceSelected(pod.Namespace) {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if event.Type == watch.Deleted {
+		s.stopStreams(pod.UID)
+		return nil
+	}
+
+	if s.podIgnored(&pod) {
+		return nil
+	}
+
+	statuses := slices.Concat(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses,
+		pod.Status.EphemeralContainerStatuses)
+
+	for _, status := range statuses {
+		ref := ContainerRef{
+			Namespace:    pod.Namespace,
+			Pod:          pod.Name,
+			PodUID:       string(pod.UID),
+			Container:    status.Name,
+			RestartCount: status.RestartCount,
+		}
+
+		s.readPreviousLog(&pod, status, ref)
+
+		if status.ContainerID == "" || (status.State.Running == nil && status.State.Terminated == nil) {
+			continue
+		}
+
+		if _, found := s.streams[status.ContainerID]; found {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		stream := &logStream{
+			ref:         ref,
+			containerID: status.ContainerID,
+			ignoreLines: s.ignoreLineRegexs(&pod),
+			cancel:      cancel,
+			done:        make(chan struct{}),
+			readers:     1,
+		}
+		s.streams[status.ContainerID] = stream
+
+		s.wg.Add(1)
+
+		go func() {
+			defer s.wg.Done()
+			defer close(stream.done)
+
+			s.followLogs(ctx, stream)
+		}()
+	}
+
+	return nil
+}
+
+// readPreviousLog reads the log of the last terminated instance of a
+// container with PodLogOptions.Previous, once the stream of the instance
+// ended. Only the lines which the stream did not receive get stored. The
+// caller must hold s.mu.
+func (s *logScraper) readPreviousLog(pod *corev1.Pod, status corev1.ContainerStatus, ref ContainerRef) {
+	terminated := status.LastTerminationState.Terminated
+	if terminated == nil || terminated.ContainerID == "" || terminated.FinishedAt.Time.Before(s.sessionStart) {
+		return
+	}
+
+	stream, found := s.streams[terminated.ContainerID]
+	if found && stream.previousRead {
+		return
+	}
+
+	if !found {
+		// The instance terminated before its stream was started. While
+		// waiting for the restart, RestartCount is the one of the terminated
+		// instance.
+		if status.State.Waiting == nil {
+			ref.RestartCount--
+		}
+
+		stream = &logStream{
+			ref:         ref,
+			containerID: terminated.ContainerID,
+			ignoreLines: s.ignoreLineRegexs(pod),
+			done:        make(chan struct{}),
+		}
+		close(stream.done)
+		s.streams[terminated.ContainerID] = stream
+	}
+
+	stream.previousRead = true
+	stream.readers++
+
+	ctx, cancel := context.WithCancel(s.ctx)
+
+	cancelStream := stream.cancel
+	stream.cancel = func() {
+		cancel()
+
+		if cancelStream != nil {
+			cancelStream()
+		}
+	}
+
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		defer s.releaseLog(stream)
+
+		select {
+		case <-stream.done:
+		case <-ctx.Done():
+			return
+		}
+
+		logs, err := s.openLogs(ctx, stream, true)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "Error reading previous logs for %s/%s [%s]: %v\n",
+					stream.ref.Namespace, stream.ref.Pod, stream.ref.Container, err)
+			}
+
+			return
+		}
+		defer logs.Close()
+
+		err = s.readLogs(ctx, stream, logs)
+		if err != nil && ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "Error reading previous logs for %s/%s [%s]: %v\n",
+				stream.ref.Namespace, stream.ref.Pod, stream.ref.Container, err)
+		}
+	}()
+}
+
+// stopStreams stops the streams of all containers of a pod. The caller must hold s.mu.
+func (s *logScraper) stopStreams(uid types.UID) {
+	for id, stream := range s.streams {
+		if stream.ref.PodUID != string(uid) {
+			continue
+		}
+
+		stream.cancel()
+		delete(s.streams, id)
+	}
+}
+
+// podIgnored returns true if the logs of the pod should not be recorded,
+// because of the ignore-log-lines file.
+func (s *logScraper) podIgnored(pod *corev1.Pod) bool {
+	for _, ignorePod := range s.args.IgnorePods {
+		if ignorePod.MatchString(pod.Name) {
+			if s.args.Verbose {
+				fmt.Printf("Skipping pod %s/%s because it matches ignore-pod-regex %q\n", pod.Namespace, pod.Name, ignorePod.String())
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *logScraper) ignoreLineRegexs(pod *corev1.Pod) []*regexp.Regexp {
+	var regexOfThisPod []*regexp.Regexp
+
+	for _, ignoreLine := range s.args.IgnoreLogLines {
+		if ignoreLine.FileRegex.MatchString(pod.Name) {
+			regexOfThisPod = append(regexOfThisPod, ignoreLine.LineRegex)
+		}
+	}
+
+	return regexOfThisPod
+}
+
+// followLogs streams the log of a container instance until the instance
+// terminated. If the stream gets interrupted while the container is running,
+// it gets reconnected, and a LogGap gets stored.
+func (s *logScraper) followLogs(ctx context.Context, stream *logStream) {
+	ref := stream.ref
+	defer s.releaseLog(stream)
+
+	fmt.Printf("Watching logs for pod %s/%s container %s (restart count %d)\n", ref.Namespace, ref.Pod, ref.Container, ref.RestartCount)
+
+	delay := minRetryDelay
+
+	// gap is set while the stream is interrupted.
+	var gap *LogGap
+
+	for {
+		logs, err := s.openLogs(ctx, stream, false)
+		if err == nil {
+			if gap != nil {
+				s.storeLogGap(gap, true)
+				gap = nil
+			}
+
+			delay = minRetryDelay
+
+			err = s.readLogs(ctx, stream, logs)
+			logs.Close()
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		state, stateErr := s.instanceState(ctx, ref, stream.containerID)
+
+		switch {
+		case stateErr != nil:
+			// For example the API server is not reachable. Try again.
+		case state == nil:
+			// The pod was deleted, or the container was restarted. In the
+			// latter case the log gets read with PodLogOptions.Previous.
+			if gap != nil {
+				s.storeLogGap(gap, false)
+			}
+
+			return
+		case state.Running != nil:
+		case state.Terminated != nil && err != nil:
+			// Read the remaining lines of the terminated container.
+		default:
+			// The container terminated, and all lines were read.
+			if gap != nil {
+				s.storeLogGap(gap, false)
+			}
+
+			return
+		}
+
+		if gap == nil {
+			gap = &LogGap{ContainerRef: ref, From: stream.last, Reason: "the log stream ended"}
+			if gap.From.IsZero() {
+				gap.From = s.sessionStart
+			}
+
+			if err != nil {
+				gap.Reason = err.Error()
+			}
+		}
+
+		fmt.Printf("Log stream of pod %s/%s container %s was interrupted, reconnecting in %s: %s\n",
+			ref.Namespace, ref.Pod, ref.Container, delay, gap.Reason)
+
+		if !sleepWithContext(ctx, delay) {
+			return
+		}
+
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// instanceState returns the state of a container instance. nil gets returned
+// if the pod or the instance does not exist anymore.
+func (s *logScraper) instanceState(ctx context.Context, ref ContainerRef, containerID string) (*corev1.ContainerState, error) {
+	pod, err := s.clientset.CoreV1().Pods(ref.Namespace).Get(ctx, ref.Pod, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("getting pod failed: %w", err)
+	}
+
+	if string(pod.UID) != ref.PodUID {
+		return nil, nil
+	}
+
+	statuses := slices.Concat(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses,
+		pod.Status.EphemeralContainerStatuses)
+
+	for _, status := range statuses {
+		if status.ContainerID == containerID {
+			return &status.State, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// storeLogGap stores a gap. If reconnected is true, the gap ends now.
+// Otherwise the stream was not reconnected, and the gap has no end.
+func (s *logScraper) storeLogGap(gap *LogGap, reconnected bool) {
+	gap.Sequence = nextSequence()
+	gap.Observed = time.Now().UTC()
+
+	if reconnected {
+		gap.To = gap.Observed
+	}
+
+	fmt.Printf("Gap in the log of pod %s/%s: %s\n", gap.Namespace, gap.Pod, gap)
+
+	err := s.store.AppendLogGap(*gap)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error storing log gap of %s/%s [%s]: %v\n", gap.Namespace, gap.Pod, gap.Container, err)
+	}
+}
+
+// releaseLog gets called when a goroutine finished reading the log of the
+// stream. The last one closes the log, so all lines of a container instance
+// get appended to one file.
+func (s *logScraper) releaseLog(stream *logStream) {
+	s.mu.Lock()
+	stream.readers--
+	last := stream.readers == 0
+	s.mu.Unlock()
+
+	if last {
+		s.closeLog(stream.ref)
+	}
+}
+
+func (s *logScraper) closeLog(ref ContainerRef) {
+	err := s.store.CloseLog(ref)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error closing log of %s/%s [%s]: %v\n", ref.Namespace, ref.Pod, ref.Container, err)
+	}
+}
+
+// openLogs opens the log of a container instance, starting at stream.last.
+// If previous is true, the log of the last terminated instance gets opened.
+func (s *logScraper) openLogs(ctx context.Context, stream *logStream, previous bool) (io.ReadCloser, error) {
+	ref := stream.ref
+
+	sinceTime := s.sessionStart
+	if stream.last.After(sinceTime) {
+		sinceTime = stream.last
+	}
+
+	if previous {
+		fmt.Printf("Reading logs of terminated pod %s/%s container %s (restart count %d)\n", ref.Namespace, ref.Pod, ref.Container, ref.RestartCount)
+	}
+
+	logs, err := s.clientset.CoreV1().Pods(ref.Namespace).GetLogs(ref.Pod,
+		&corev1.PodLogOptions{
+			Container:  ref.Container,
+			Follow:     !previous,
+			Previous:   previous,
+			SinceTime:  &metav1.Time{Time: sinceTime},
+			Timestamps: true,
+		},
+	).Stream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("streaming logs failed: %w", err)
+	}
+
+	return logs, nil
+}
+
+// readLogs stores the lines of logs. The timestamps of the lines are the ones
+// of the container runtime. Lines which are not newer than the lines which
+// were already read get skipped: SinceTime has a precision of seconds, so a
+// reconnected stream repeats lines. Lines longer than maxLogLineLength get
+// truncated, so they don't break the stream.
+func (s *logScraper) readLogs(ctx context.Context, stream *logStream, logs io.Reader) error {
+	ref := stream.ref
+	namespace, podName, containerName := ref.Namespace, ref.Pod, ref.Container
+
+	// skip is the number of lines with the timestamp stream.last which were
+	// already read.
+	skip := stream.lastCount
+
+	reader := bufio.NewReader(logs)
+
+	for {
+		text, length, err := readLogLine(reader)
+		if errors.Is(err, io.EOF) && text == "" {
+			return nil
+		}
+
+		if err != nil && !errors.Is(err, io.EOF) {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("reading logs failed: %w", err)
+		}
+
+		timestamp, line := splitLogTimestamp(text)
+
+		if !timestamp.IsZero() {
+			switch {
+			case timestamp.Before(stream.last):
+				continue
+			case timestamp.Equal(stream.last) && skip > 0:
+				skip--
+				continue
+			case timestamp.Equal(stream.last):
+				stream.lastCount++
+			default:
+				stream.last = timestamp
+				stream.lastCount = 1
+				skip = 0
+			}
+		}
+
+		ignored := slices.ContainsFunc(stream.ignoreLines, func(r *regexp.Regexp) bool {
+			return r.MatchString(line)
+		})
+		if ignored {
+			fmt.Printf("Ignoring log line for pod %s/%s container %s: %q\n", namespace, podName, containerName, line)
+			continue
+		}
+
+		if length > len(text) {
+			fmt.Printf("Truncated log line of pod %s/%s container %s from %d to %d bytes\n",
+				namespace, podName, containerName, length, len(text))
+		}
+
+		err = s.store.AppendLogLine(LogLine{
+			ContainerRef: ref,
+			Sequence:     nextSequence(),
+			Observed:     time.Now().UTC(),
+			Timestamp:    timestamp,
+			Line:         line,
+		})
+		if err != nil {
+			fmt.Printf("Error storing log line for pod %s/%s container %s: %s\n", namespace, podName, containerName, err)
+			continue
+		}
+
+		s.args.Stats.logLineStored()
+
+		if s.args.Verbose {
+			fmt.Printf("Stored log line for pod %s/%s container %s\n", namespace, podName, containerName)
+		}
+	}
+}
+
+// maxLogLineLength is the maximal length of a stored log line. Longer lines
+// get truncated.
+const maxLogLineLength = 1024 * 1024
+
+// readLogLine returns the next line of r without the line ending, truncated
+// to maxLogLineLength, and the length of the complete line.
+func readLogLine(r *bufio.Reader) (string, int, error) {
+	var (
+		line   []byte
+		length int
+	)
+
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if err == nil {
+			chunk = chunk[:len(chunk)-1]
+		}
+
+		length += len(chunk)
+		line = append(line, chunk[:min(len(chunk), maxLogLineLength-len(line))]...)
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+
+		if err == nil && length == len(line) && bytes.HasSuffix(line, []byte("\r")) {
+			line = line[:len(line)-1]
+			length--
+		}
+
+		return string(line), length, err
+	}
+}
@@ -0,0 +1,171 @@
+package record
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logLineStore keeps the appended log lines in memory. The other methods of
+// Store are not implemented.
+type logLineStore struct {
+	Store
+
+	lines  []string
+	closed []ContainerRef
+}
+
+func (s *logLineStore) AppendLogLine(line LogLine) error {
+	if slices.Contains(s.closed, line.ContainerRef) {
+		return fmt.Errorf("the log of %+v was closed", line.ContainerRef)
+	}
+
+	s.lines = append(s.lines, line.Timestamp.Format(time.RFC3339Nano)+" "+line.Line)
+
+	return nil
+}
+
+func (s *logLineStore) CloseLog(ref ContainerRef) error {
+	s.closed = append(s.closed, ref)
+	return nil
+}
+
+func TestSplitLogTimestamp(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		wantTime time.Time
+		wantLine string
+	}{
+		{"2025-02-27T15:00:00.5Z hello world", time.Date(2025, 2, 27, 15, 0, 0, 5e8, time.UTC), "hello world"},
+		{"2025-02-27T15:00:00Z ", time.Date(2025, 2, 27, 15, 0, 0, 0, time.UTC), ""},
+		{"no timestamp", time.Time{}, "no timestamp"},
+		{"no-space", time.Time{}, "no-space"},
+	} {
+		gotTime, gotLine := splitLogTimestamp(tc.in)
+		if !gotTime.Equal(tc.wantTime) || gotLine != tc.wantLine {
+			t.Errorf("%q: got %v %q, want %v %q", tc.in, gotTime, gotLine, tc.wantTime, tc.wantLine)
+		}
+	}
+}
+
+// TestReadReconnectedLogs feeds a stream which gets interrupted, and a second
+// stream which starts again at the second of the last line, like the
+// SinceTime of the API does. Lines of the same second must neither get lost
+// nor stored twice.
+func TestReadReconnectedLogs(t *testing.T) {
+	store := &logLineStore{}
+	s := &logScraper{args: &Arguments{}, store: store}
+	stream := &logStream{ref: ContainerRef{Namespace: "default", Pod: "pod", Container: "app"}}
+
+	first := []string{
+		"2025-02-27T15:00:00.1Z a",
+		"2025-02-27T15:00:00.5Z b",
+		"2025-02-27T15:00:00.5Z c",
+	}
+
+	second := []string{
+		"2025-02-27T15:00:00.1Z a",
+		"2025-02-27T15:00:00.5Z b",
+		"2025-02-27T15:00:00.5Z c",
+		// Same timestamp as b and c, but new.
+		"2025-02-27T15:00:00.5Z d",
+		"2025-02-27T15:00:01Z e",
+		"2025-02-27T15:00:01Z e",
+	}
+
+	for _, lines := range [][]string{first, second} {
+		err := s.readLogs(context.Background(), stream, strings.NewReader(strings.Join(lines, "\n")+"\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{
+		"2025-02-27T15:00:00.1Z a",
+		"2025-02-27T15:00:00.5Z b",
+		"2025-02-27T15:00:00.5Z c",
+		"2025-02-27T15:00:00.5Z d",
+		"2025-02-27T15:00:01Z e",
+		"2025-02-27T15:00:01Z e",
+	}
+
+	if !slices.Equal(store.lines, want) {
+		t.Errorf("got lines\n%s\nwant\n%s", strings.Join(store.lines, "\n"), strings.Join(want, "\n"))
+	}
+
+	// A third stream which repeats everything stores nothing.
+	err := s.readLogs(context.Background(), stream, strings.NewReader(strings.Join(second, "\n")+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.lines) != len(want) {
+		t.Errorf("got %d lines after repeating the stream, want %d", len(store.lines), len(want))
+	}
+}
+
+// TestReadLongLogLine reads a line which is longer than maxLogLineLength. It
+// gets truncated, and the following lines get read.
+func TestReadLongLogLine(t *testing.T) {
+	store := &logLineStore{}
+	s := &logScraper{args: &Arguments{}, store: store}
+	stream := &logStream{ref: ContainerRef{Namespace: "default", Pod: "pod", Container: "app"}}
+
+	prefix := "2025-02-27T15:00:00.5Z "
+	long := prefix + strings.Repeat("x", 2*maxLogLineLength)
+	logs := "2025-02-27T15:00:00.1Z a\n" + long + "\r\n2025-02-27T15:00:01Z b"
+
+	err := s.readLogs(context.Background(), stream, strings.NewReader(logs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"2025-02-27T15:00:00.1Z a",
+		long[:maxLogLineLength],
+		"2025-02-27T15:00:01Z b",
+	}
+
+	if !slices.Equal(store.lines, want) {
+		t.Errorf("got %d lines with lengths %v, want lengths %v", len(store.lines), lineLengths(store.lines),
+			lineLengths(want))
+	}
+}
+
+func lineLengths(lines []string) []int {
+	lengths := make([]int, 0, len(lines))
+	for _, line := range lines {
+		lengths = append(lengths, len(line))
+	}
+
+	return lengths
+}
+
+// TestReleaseLog reads the log of a terminated instance after its stream
+// ended. The log must be closed once, after both finished.
+func TestReleaseLog(t *testing.T) {
+	store := &logLineStore{}
+	s := &logScraper{args: &Arguments{}, store: store}
+	stream := &logStream{ref: ContainerRef{Namespace: "default", Pod: "pod", Container: "app"}, readers: 2}
+
+	// The stream ended.
+	s.releaseLog(stream)
+
+	if len(store.closed) != 0 {
+		t.Fatal("the log was closed while the terminated instance gets read")
+	}
+
+	err := s.readLogs(context.Background(), stream, strings.NewReader("2025-02-27T15:00:00.1Z last words\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.releaseLog(stream)
+
+	if len(store.lines) != 1 || len(store.closed) != 1 {
+		t.Errorf("got %d lines and %d closes, want 1 and 1", len(store.lines), len(store.closed))
+	}
+}
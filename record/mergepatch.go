@@ -0,0 +1,91 @@
+package record
+
+import (
+	"reflect"
+)
+
+// createMergePatch returns a JSON merge patch (RFC 7386) which turns original
+// into modified. Null values can't be expressed by a merge patch, because
+// null means "remove". See containsNull.
+func createMergePatch(original, modified map[string]any) map[string]any {
+	patch := make(map[string]any)
+
+	for key := range original {
+		if _, found := modified[key]; !found {
+			patch[key] = nil
+		}
+	}
+
+	for key, m := range modified {
+		o, found := original[key]
+		if !found {
+			patch[key] = m
+			continue
+		}
+
+		oMap, oIsMap := o.(map[string]any)
+		mMap, mIsMap := m.(map[string]any)
+
+		if oIsMap && mIsMap {
+			sub := createMergePatch(oMap, mMap)
+			if len(sub) > 0 {
+				patch[key] = sub
+			}
+
+			continue
+		}
+
+		if !reflect.DeepEqual(o, m) {
+			patch[key] = m
+		}
+	}
+
+	return patch
+}
+
+// applyMergePatch applies a JSON merge patch (RFC 7386) to target. Maps of
+// target get modified.
+func applyMergePatch(target, patch any) any {
+	patchMap, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetMap, ok := target.(map[string]any)
+	if !ok {
+		targetMap = make(map[string]any)
+	}
+
+	for key, value := range patchMap {
+		if value == nil {
+			delete(targetMap, key)
+			continue
+		}
+
+		targetMap[key] = applyMergePatch(targetMap[key], value)
+	}
+
+	return targetMap
+}
+
+// containsNull returns true if v contains a null value at any level.
+func containsNull(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case map[string]any:
+		for _, value := range v {
+			if containsNull(value) {
+				return true
+			}
+		}
+	case []any:
+		for _, value := range v {
+			if containsNull(value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
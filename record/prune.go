@@ -0,0 +1,410 @@
+package record
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"sigs.k8s.io/yaml"
+)
+
+// pruneInterval is the time between two runs of Prune while recording.
+const pruneInterval = time.Minute
+
+// PruneOptions limit the size of a recording. Zero values mean no limit.
+//
+// The first and the last version of each object are always kept: the first
+// one so that later versions can still be diffed, the last one because it is
+// the current state of the object.
+type PruneOptions struct {
+	// MaxSize is the maximum size of all files in bytes. The oldest files get
+	// deleted first.
+	MaxSize int64
+
+	// MaxAge: older versions and log files get deleted. The age of a log file
+	// is the time of its last line.
+	MaxAge time.Duration
+
+	// MaxVersionsPerObject is the maximum number of versions of an object.
+	MaxVersionsPerObject int
+
+	// Recipients encrypt full versions which replace encrypted patches.
+	// Default: the recipients of the identities given by SetIdentities.
+	Recipients []age.Recipient
+}
+
+// Enabled returns true if at least one limit is set.
+func (o PruneOptions) Enabled() bool {
+	return o.MaxSize > 0 || o.MaxAge > 0 || o.MaxVersionsPerObject > 0
+}
+
+// PruneResult describes what Prune deleted.
+type PruneResult struct {
+	Files int
+	Bytes int64
+}
+
+func (r PruneResult) String() string {
+	return fmt.Sprintf("%d files, %d bytes", r.Files, r.Bytes)
+}
+
+// Pruner is implemented by stores which support retention limits.
+type Pruner interface {
+	Prune(opts PruneOptions, now time.Time) (PruneResult, error)
+}
+
+// pruneFile is a version or a log file of the directory layout.
+type pruneFile struct {
+	dir      string
+	name     string
+	session  int
+	sequence uint64
+	observed time.Time
+	size     int64
+
+	// protected files must not be deleted.
+	protected bool
+	deleted   bool
+}
+
+// Prune deletes files of a recording in the directory layout (DirStore) to
+// meet the limits. baseDir is the directory of one cluster. Patches which
+// would lose their keyframe get replaced by a full version.
+//
+// Prune must not run concurrently with a DirStore writing to baseDir. While
+// recording use DirStore.Prune.
+func Prune(baseDir string, opts PruneOptions, now time.Time) (PruneResult, error) {
+	starts, err := sessionStarts(baseDir)
+	if err != nil {
+		return PruneResult{}, err
+	}
+
+	if len(starts) == 0 {
+		return PruneResult{}, fmt.Errorf("%q is not the directory of a cluster. No start marker (%s*) found",
+			baseDir, StartMarkerPrefix)
+	}
+
+	return prune(baseDir, opts, now, nil)
+}
+
+// prune is Prune. The files in openFiles are log files which get appended,
+// they are not deleted.
+func prune(baseDir string, opts PruneOptions, now time.Time, openFiles map[string]bool) (PruneResult, error) {
+	var result PruneResult
+
+	if !opts.Enabled() {
+		return result, nil
+	}
+
+	recipients := opts.Recipients
+	if recipients == nil {
+		recipients = recipientsOfIdentities()
+	}
+
+	filesByDir, totalSize, err := collectPruneFiles(baseDir, openFiles)
+	if err != nil {
+		return result, err
+	}
+
+	var candidates []*pruneFile
+
+	for _, files := range filesByDir {
+		if opts.MaxVersionsPerObject > 0 {
+			markSurplusVersions(files, opts.MaxVersionsPerObject)
+		}
+
+		for _, f := range files {
+			if f.protected || f.deleted {
+				continue
+			}
+
+			if opts.MaxAge > 0 && now.Sub(f.observed) > opts.MaxAge {
+				f.deleted = true
+				continue
+			}
+
+			candidates = append(candidates, f)
+		}
+	}
+
+	for _, files := range filesByDir {
+		for _, f := range files {
+			if f.deleted {
+				totalSize -= f.size
+			}
+		}
+	}
+
+	if opts.MaxSize > 0 && totalSize > opts.MaxSize {
+		slices.SortFunc(candidates, func(a, b *pruneFile) int {
+			return cmp.Or(a.observed.Compare(b.observed), cmp.Compare(a.sequence, b.sequence))
+		})
+
+		for _, f := range candidates {
+			if totalSize <= opts.MaxSize {
+				break
+			}
+
+			f.deleted = true
+			totalSize -= f.size
+		}
+	}
+
+	for dir, files := range filesByDir {
+		err := pruneDir(dir, files, recipients, &result)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// collectPruneFiles returns the versions and log files below baseDir, grouped
+// by directory and ordered by session and sequence number, and the size of
+// all files.
+func collectPruneFiles(baseDir string, openFiles map[string]bool) (map[string][]*pruneFile, int64, error) {
+	baseDir = filepath.Clean(baseDir)
+	filesByDir := make(map[string][]*pruneFile)
+
+	// startsByDir caches the session starts of the cluster directory of each
+	// object directory.
+	startsByDir := make(map[string][]string)
+
+	var totalSize int64
+
+	err := filepath.WalkDir(baseDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("entry.Info() failed: %w", err)
+		}
+
+		totalSize += info.Size()
+
+		dir := filepath.Dir(path)
+		name := entry.Name()
+
+		// Markers, journal segments and index files are not pruned.
+		if dir == baseDir || strings.HasPrefix(name, IndexFile) {
+			return nil
+		}
+
+		if !IsVersionFile(name) && !IsLogFile(name) && !IsLogGapFile(name) {
+			return nil
+		}
+
+		observed, seq, _, err := ParseVersionFileName(name)
+		if err != nil {
+			return fmt.Errorf("ParseVersionFileName() failed: %w", err)
+		}
+
+		if IsLogFile(name) {
+			// The name contains the time of the first line.
+			observed = info.ModTime()
+		}
+
+		starts, found := startsByDir[dir]
+		if !found {
+			starts, err = findSessionStarts(dir)
+			if err != nil {
+				return err
+			}
+
+			startsByDir[dir] = starts
+		}
+
+		filesByDir[dir] = append(filesByDir[dir], &pruneFile{
+			dir:       dir,
+			name:      name,
+			session:   sessionIndex(starts, name),
+			sequence:  seq,
+			observed:  observed,
+			size:      info.Size(),
+			protected: openFiles[path],
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("filepath.WalkDir() failed: %w", err)
+	}
+
+	for _, files := range filesByDir {
+		slices.SortFunc(files, func(a, b *pruneFile) int {
+			return cmp.Or(cmp.Compare(a.session, b.session), cmp.Compare(a.sequence, b.sequence),
+				strings.Compare(a.name, b.name))
+		})
+
+		var versions []*pruneFile
+
+		for _, f := range files {
+			if IsVersionFile(f.name) {
+				versions = append(versions, f)
+			}
+		}
+
+		if len(versions) > 0 {
+			versions[0].protected = true
+			versions[len(versions)-1].protected = true
+		}
+	}
+
+	return filesByDir, totalSize, nil
+}
+
+// markSurplusVersions marks the oldest versions as deleted, so that at most
+// maxVersions versions are left.
+func markSurplusVersions(files []*pruneFile, maxVersions int) {
+	count := 0
+
+	for _, f := range files {
+		if IsVersionFile(f.name) {
+			count++
+		}
+	}
+
+	for _, f := range files {
+		if count <= maxVersions {
+			return
+		}
+
+		if f.protected || !IsVersionFile(f.name) {
+			continue
+		}
+
+		f.deleted = true
+		count--
+	}
+}
+
+// pruneDir deletes the marked files of a directory. Before that, patches
+// which are based on a deleted file get replaced by a full version.
+func pruneDir(dir string, files []*pruneFile, recipients []age.Recipient, result *PruneResult) error {
+	deleted := make(map[string]bool)
+	renamed := make(map[string]string)
+
+	// broken contains the deleted versions since the last keyframe.
+	var broken []*pruneFile
+
+	for _, f := range files {
+		if !IsVersionFile(f.name) {
+			continue
+		}
+
+		switch {
+		case !IsPatchFile(f.name):
+			// Later patches are based on this keyframe.
+			broken = nil
+			if f.deleted {
+				broken = append(broken, f)
+			}
+		case f.deleted:
+			broken = append(broken, f)
+		case len(broken) > 0:
+			newName, err := materializePatch(dir, f.name, recipients)
+			if errors.Is(err, ErrNoIdentity) || errors.Is(err, errNoRecipient) {
+				// An encrypted patch, which can't be replaced. For example
+				// while recording, because only the recipients are known.
+				// Keep the versions the patch is based on.
+				for _, b := range broken {
+					b.deleted = false
+				}
+
+				broken = nil
+
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			renamed[f.name] = newName
+			broken = nil
+		}
+	}
+
+	for _, f := range files {
+		if !f.deleted {
+			continue
+		}
+
+		err := os.Remove(filepath.Join(dir, f.name))
+		if err != nil {
+			return fmt.Errorf("os.Remove() failed: %w", err)
+		}
+
+		deleted[f.name] = true
+		result.Files++
+		result.Bytes += f.size
+	}
+
+	if len(deleted) == 0 && len(renamed) == 0 {
+		return nil
+	}
+
+	return rewriteIndex(dir, deleted, renamed)
+}
+
+// materializePatch replaces a patch by the full version and returns the new
+// basename. Encrypted patches get decrypted with the identities given by
+// SetIdentities, and the full version gets encrypted for recipients.
+func materializePatch(dir, name string, recipients []age.Recipient) (string, error) {
+	encrypted := IsEncrypted(name)
+	if encrypted && len(recipients) == 0 {
+		return "", fmt.Errorf("%q: %w", name, errNoRecipient)
+	}
+
+	if !encrypted {
+		recipients = nil
+	}
+
+	obj, err := ReadVersion(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return "", fmt.Errorf("yaml.Marshal(obj) failed: %w", err)
+	}
+
+	compression := fileCompression(name)
+
+	data, err = encode(data, compression, recipients)
+	if err != nil {
+		return "", err
+	}
+
+	newName := strings.TrimSuffix(TrimCompressionSuffix(name), PatchSuffix) + ".yaml" + compression.Suffix()
+	if encrypted {
+		newName += EncryptionSuffix
+	}
+
+	err = os.WriteFile(filepath.Join(dir, newName), data, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("os.WriteFile() failed: %w", err)
+	}
+
+	err = os.Remove(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("os.Remove() failed: %w", err)
+	}
+
+	return newName, nil
+}
@@ -0,0 +1,188 @@
+package record
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// storedPrefixes returns the names of the stored versions in dir without the
+// suffix, like they get returned by recordTestSession.
+func storedPrefixes(t *testing.T, dir string) []string {
+	t.Helper()
+
+	versions, err := listVersions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefixes := make([]string, 0, len(versions))
+	for _, v := range versions {
+		prefixes = append(prefixes, VersionFileName(v.observed, v.sequence, ""))
+	}
+
+	return prefixes
+}
+
+// assertVersion fails if the stored version with the prefix is not version i
+// of the session.
+func assertVersion(t *testing.T, dir, prefix, session string, i int) {
+	t.Helper()
+
+	name := findVersionFile(t, dir, prefix)
+
+	obj, err := ReadVersion(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotSession := obj.GetLabels()["session"]
+	gotVersion, _, _ := unstructured.NestedString(obj.Object, "data", "version")
+
+	if gotSession != session || gotVersion != fmt.Sprint(i) {
+		t.Errorf("%q: got version %q of session %q, want %d of %q", name, gotVersion, gotSession, i, session)
+	}
+}
+
+func TestPruneMaxVersionsPerObjectOfSeveralSessions(t *testing.T) {
+	baseDir := t.TempDir()
+	opts := StoreOptions{KeyframeInterval: 20}
+	start := time.Date(2025, 2, 27, 15, 0, 0, 0, time.UTC)
+
+	first := recordTestSession(t, baseDir, opts, "first", start, 6)
+	second := recordTestSession(t, baseDir, opts, "second", start.Add(2*time.Hour), 3)
+
+	result, err := Prune(baseDir, PruneOptions{MaxVersionsPerObject: 4}, start.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Files != 5 {
+		t.Errorf("got %d deleted files, want 5", result.Files)
+	}
+
+	// The oldest versions get deleted, except the first one.
+	dir := objectDir(baseDir)
+	want := append([]string{first[0]}, second...)
+
+	if got := storedPrefixes(t, dir); !slices.Equal(got, want) {
+		t.Fatalf("got versions %v, want %v", got, want)
+	}
+
+	assertVersion(t, dir, first[0], "first", 1)
+
+	for i, prefix := range second {
+		assertVersion(t, dir, prefix, "second", i+1)
+	}
+}
+
+// TestPruneParentDirectory prunes the directory which contains the cluster
+// directories, like watchall-output.
+func TestPruneParentDirectory(t *testing.T) {
+	outputDir := t.TempDir()
+	baseDir := filepath.Join(outputDir, "127.0.0.1:6443")
+	opts := StoreOptions{KeyframeInterval: 20}
+	start := time.Date(2025, 2, 27, 15, 0, 0, 0, time.UTC)
+
+	first := recordTestSession(t, baseDir, opts, "first", start, 6)
+	second := recordTestSession(t, baseDir, opts, "second", start.Add(2*time.Hour), 3)
+	dir := objectDir(baseDir)
+
+	_, err := Prune(outputDir, PruneOptions{MaxVersionsPerObject: 4}, start.Add(3*time.Hour))
+	if err == nil {
+		t.Fatal("pruning a directory without start markers must fail")
+	}
+
+	if got := storedPrefixes(t, dir); len(got) != len(first)+len(second) {
+		t.Fatalf("versions were deleted: %v", got)
+	}
+
+	// The sessions get found in the cluster directory anyway.
+	_, err = prune(outputDir, PruneOptions{MaxVersionsPerObject: 4}, start.Add(3*time.Hour), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := append([]string{first[0]}, second...)
+
+	if got := storedPrefixes(t, dir); !slices.Equal(got, want) {
+		t.Fatalf("got versions %v, want %v", got, want)
+	}
+}
+
+func TestPruneMaxAge(t *testing.T) {
+	baseDir := t.TempDir()
+	start := time.Date(2025, 2, 27, 15, 0, 0, 0, time.UTC)
+
+	first := recordTestSession(t, baseDir, StoreOptions{}, "first", start, 4)
+	second := recordTestSession(t, baseDir, StoreOptions{}, "second", start.Add(2*time.Hour), 3)
+
+	// All versions of the first session are older than one hour.
+	_, err := Prune(baseDir, PruneOptions{MaxAge: time.Hour}, start.Add(2*time.Hour+30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := objectDir(baseDir)
+	want := append([]string{first[0]}, second...)
+
+	if got := storedPrefixes(t, dir); !slices.Equal(got, want) {
+		t.Fatalf("got versions %v, want %v", got, want)
+	}
+
+	index, err := ReadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(index) != len(want) {
+		t.Errorf("the index has %d entries, want %d", len(index), len(want))
+	}
+}
+
+func TestPruneMaterializesPatch(t *testing.T) {
+	baseDir := t.TempDir()
+	start := time.Date(2025, 2, 27, 15, 0, 0, 0, time.UTC)
+
+	names := recordTestSession(t, baseDir, StoreOptions{KeyframeInterval: 20}, "first", start, 6)
+
+	// Versions 2 and 3 get deleted. Version 4 is a patch against version 3.
+	_, err := Prune(baseDir, PruneOptions{MaxVersionsPerObject: 4}, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := objectDir(baseDir)
+	want := []string{names[0], names[3], names[4], names[5]}
+
+	if got := storedPrefixes(t, dir); !slices.Equal(got, want) {
+		t.Fatalf("got versions %v, want %v", got, want)
+	}
+
+	materialized := findVersionFile(t, dir, names[3])
+	if IsPatchFile(materialized) {
+		t.Errorf("%q should have been replaced by a full version", materialized)
+	}
+
+	index, err := ReadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := index[materialized]; !found {
+		t.Errorf("the index does not contain %q", materialized)
+	}
+
+	for _, i := range []int{1, 4, 5, 6} {
+		assertVersion(t, dir, names[i-1], "first", i)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, names[3]+PatchSuffix)); !os.IsNotExist(err) {
+		t.Errorf("the patch of version 4 was not removed: %v", err)
+	}
+}
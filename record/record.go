@@ -1,11 +1,9 @@
 package record
 
 import (
-	"bufio"
 	"context"
-	"crypto/sha256"
 	"fmt"
-	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"slices"
@@ -13,22 +11,24 @@ import (
 	"sync"
 	"time"
 
-	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/utils/ptr"
-	"sigs.k8s.io/yaml"
 )
 
 const TimeFormat = "20060102-150405.00000"
 
-const groupAuthorization = "authorization.k8s.io"
+// TombstoneSuffix is the suffix of files which contain the last state of a deleted object.
+const TombstoneSuffix = ".deleted.yaml"
 
 type IgnoreLogLine struct {
 	FileRegex *regexp.Regexp
@@ -38,15 +38,100 @@ type IgnoreLogLine struct {
 type Arguments struct {
 	Verbose                  bool
 	OutputDirectory          string
-	Namespace                string
+	Namespaces               []string
+	ExcludeNamespaces        []string
+	SkipClusterScoped        bool
 	WithLogs                 bool
 	DisableResourceRecording bool
 	IgnoreLogLinesFile       string
 	IgnoreLogLines           []IgnoreLogLine
 	IgnorePods               []*regexp.Regexp
+
+	// SkipResources and OnlyResources contain glob patterns (see path.Match)
+	// of the form group/resource. The group of core resources is "core".
+	SkipResources []string
+	OnlyResources []string
+
+	// LabelSelector and FieldSelector get used for all resources, except for
+	// resources which have an entry in Selectors.
+	LabelSelector string
+	FieldSelector string
+	Selectors     []ResourceSelector
+
+	// Stats gets updated while recording, if not nil.
+	Stats *Stats
+
+	// Until gets checked for every stored object, if not nil. The caller is
+	// responsible to stop the recording when the condition holds.
+	Until *UntilCondition
+
+	// NewStore creates the Store of each cluster. Default: NewDirStore.
+	NewStore StoreFactory
+
+	// KeepUnchanged disables dropping versions which are equal to the last
+	// stored version after StripIrrelevantFields and removing IgnorePaths.
+	KeepUnchanged bool
+
+	// IgnorePaths are dotted paths (see ParseIgnorePath) which get ignored
+	// when comparing a version with the last stored version.
+	IgnorePaths []string
+
+	ignorePaths [][]string
+
+	// RedactionRules get applied after DefaultRedactionRules, before
+	// anything gets stored.
+	RedactionRules []RedactionRule
+
+	// RedactionKey is the HMAC key of RedactHash. If nil, a random key gets
+	// created for each session. Pass the same key to all clusters of a
+	// process, so their hashes can be compared.
+	RedactionKey []byte
+
+	redactor *redactor
+
+	// Retention limits the size of the recording. The store must implement
+	// Pruner if a limit is set.
+	Retention PruneOptions
+}
+
+// ResourceSelector overrides LabelSelector and FieldSelector of Arguments for
+// some resources.
+type ResourceSelector struct {
+	// Resource is a group/resource pattern like in Arguments.SkipResources.
+	Resource      string `json:"resource"`
+	LabelSelector string `json:"labelSelector,omitempty"`
+	FieldSelector string `json:"fieldSelector,omitempty"`
 }
 
 func RunRecordWithContext(ctx context.Context, args Arguments, kubeconfig clientcmd.ClientConfig) (*sync.WaitGroup, error) {
+	err := validateResourcePatterns(append(slices.Clone(args.SkipResources), args.OnlyResources...))
+	if err != nil {
+		return nil, err
+	}
+
+	err = args.validateSelectors()
+	if err != nil {
+		return nil, err
+	}
+
+	args.ignorePaths, err = parseIgnorePaths(args.IgnorePaths)
+	if err != nil {
+		return nil, err
+	}
+
+	redactionKey := args.RedactionKey
+	if redactionKey == nil {
+		redactionKey, err = NewRedactionKey()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	args.redactor, err = newRedactor(append(slices.Clone(DefaultRedactionRules), args.RedactionRules...), redactionKey)
+	if err != nil {
+		return nil, err
+	}
+
 	config, err := kubeconfig.ClientConfig()
 	if err != nil {
 		return nil, fmt.Errorf("kubeconfig.ClientConfig() failed: %w", err)
@@ -65,242 +150,603 @@ func RunRecordWithContext(ctx context.Context, args Arguments, kubeconfig client
 		return nil, fmt.Errorf("dynamic.NewForConfig() failed: %w", err)
 	}
 
-	discoveryClient := clientset.Discovery()
+	newStore := args.NewStore
+	if newStore == nil {
+		newStore = NewDirStore
+	}
 
-	// Get the list of all API resources available
-	serverResources, err := discoveryClient.ServerPreferredResources()
+	store, err := newStore(filepath.Join(args.OutputDirectory, HostName(config)))
 	if err != nil {
-		if discovery.IsGroupDiscoveryFailedError(err) {
-			fmt.Printf("WARNING: The Kubernetes server has an orphaned API service. Server reports: %s\n", err.Error())
-			fmt.Printf("WARNING: To fix this, kubectl delete apiservice <service-name>\n")
-		} else {
-			return nil, fmt.Errorf("discoveryClient.ServerPreferredResources() failed: %w", err)
-		}
+		return nil, fmt.Errorf("creating store failed: %w", err)
 	}
 
-	host := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(config.Host, "https://"), "http://"), ":443")
+	pruner, ok := store.(Pruner)
+	if args.Retention.Enabled() && !ok {
+		return nil, fmt.Errorf("the store %T does not support retention limits", store)
+	}
 
-	var wg sync.WaitGroup
+	sessionStart := time.Now()
+
+	err = store.StartSession(SessionInfo{
+		Start:          sessionStart,
+		RedactionKeyID: RedactionKeyID(redactionKey),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("store.StartSession() failed: %w", err)
+	}
+
+	// workers contains all goroutines which record something.
+	var workers sync.WaitGroup
 
 	if !args.DisableResourceRecording {
-		err = createRecorders(ctx, &wg, serverResources, args, dynClient, host)
+		err = createRecorders(ctx, &workers, clientset.Discovery(), args, dynClient, store)
 		if err != nil {
 			return nil, fmt.Errorf("createRecorders() failed: %w", err)
 		}
 	}
 
 	if args.WithLogs {
-		err = createLogScraper(ctx, &wg, clientset, args, host)
-		if err != nil {
-			return nil, fmt.Errorf("createLogScraper() failed: %w", err)
-		}
+		createLogScraper(ctx, &workers, clientset, dynClient, args, store, sessionStart)
 	}
 
-	return &wg, nil
-}
+	if args.Retention.Enabled() {
+		workers.Add(1)
 
-func createLogScraper(ctx context.Context, wg *sync.WaitGroup,
-	clientset *kubernetes.Clientset, args Arguments, host string,
-) error {
-	pods, err := clientset.CoreV1().Pods(args.Namespace).List(ctx, metav1.ListOptions{})
-	if err != nil {
-		return fmt.Errorf("clientset.CoreV1().Pods().List() failed: %w", err)
+		go runPruner(ctx, &workers, pruner, args.Retention)
 	}
 
-	for _, pod := range pods.Items {
-		skip := false
+	// The returned WaitGroup is done after all workers have finished their
+	// writes (usually because ctx was cancelled), and the end marker was written.
+	var wg sync.WaitGroup
 
-		for _, ignorePod := range args.IgnorePods {
-			if ignorePod.MatchString(pod.Name) {
-				fmt.Printf("Skipping pod %s/%s because it matches ignore-pod-regex %q\n", pod.Namespace, pod.Name, ignorePod.String())
+	wg.Add(1)
 
-				skip = true
+	go func() {
+		defer wg.Done()
 
-				break
-			}
-		}
+		workers.Wait()
 
-		if skip {
-			continue
+		err := store.EndSession(time.Now())
+		if err != nil {
+			fmt.Printf("Error ending session: %v\n", err)
 		}
+	}()
 
-		var regexOfThisPod []*regexp.Regexp
+	return &wg, nil
+}
 
-		for _, ignoreLine := range args.IgnoreLogLines {
-			if ignoreLine.FileRegex.MatchString(pod.Name) {
-				regexOfThisPod = append(regexOfThisPod, ignoreLine.LineRegex)
-			}
+// runPruner enforces the retention limits until ctx is done.
+func runPruner(ctx context.Context, wg *sync.WaitGroup, pruner Pruner, opts PruneOptions) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		result, err := pruner.Prune(opts, time.Now())
+		if err != nil {
+			fmt.Printf("Error pruning the recording: %v\n", err)
+			continue
 		}
 
-		for _, container := range pod.Spec.Containers {
-			wg.Add(1)
-			go readPodLogs(ctx, wg, clientset, args, host, pod.Name, pod.Namespace,
-				container.Name, regexOfThisPod)
+		if result.Files > 0 {
+			fmt.Printf("Pruned %s\n", result)
 		}
 	}
-
-	return nil
 }
 
-func readPodLogs(ctx context.Context, wg *sync.WaitGroup, clientset *kubernetes.Clientset, args Arguments, host, podName, namespace, containerName string, ignoreLineRegexs []*regexp.Regexp) {
-	defer wg.Done()
+const (
+	// StartMarkerPrefix is the prefix of the empty file which gets created
+	// when a recording session starts. The suffix is the time in TimeFormat.
+	StartMarkerPrefix = "record-"
+
+	// EndMarkerPrefix is the prefix of the empty file which gets created when
+	// a recording session ended cleanly. The suffix is the time in TimeFormat.
+	EndMarkerPrefix = "record-end-"
+)
 
-	fmt.Printf("Watching logs for pod %s/%s container %s\n", namespace, podName, containerName)
+// HostName returns the name of the directory of the cluster below
+// Arguments.OutputDirectory.
+func HostName(config *rest.Config) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(config.Host, "https://"), "http://"), ":443")
+}
+
+func createRecorders(ctx context.Context, wg *sync.WaitGroup, discoveryClient discovery.DiscoveryInterface, args Arguments, dynClient *dynamic.DynamicClient, store Store) error {
+	r := &recorder{
+		args:            &args,
+		dynClient:       dynClient,
+		discoveryClient: discoveryClient,
+		store:           store,
+		wg:              wg,
+		watchers:        make(map[schema.GroupVersionResource]context.CancelFunc),
+	}
 
-	stream, err := clientset.CoreV1().Pods(namespace).GetLogs(podName,
-		&corev1.PodLogOptions{
-			Container:    containerName,
-			Follow:       true,
-			SinceSeconds: ptr.To(int64(1)),
-		},
-	).Stream(ctx)
+	err := r.discover(ctx)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error streaming logs for %s/%s [%s]: %v\n", namespace, podName, containerName, err)
-		return
+		return err
 	}
-	defer stream.Close()
 
-	scanner := bufio.NewScanner(stream)
-	for scanner.Scan() {
-		line := scanner.Text()
-		for _, ignoreLineRegex := range ignoreLineRegexs {
-			if ignoreLineRegex.MatchString(line) {
-				fmt.Printf("Ignoring log line for pod %s/%s container %s: %q\n", namespace, podName, containerName, line)
-				continue
-			}
-		}
+	r.watchAPIChanges(ctx)
 
-		dir := filepath.Join(args.OutputDirectory, host, "core", "Pod", namespace, podName)
+	return nil
+}
 
-		err = os.MkdirAll(dir, 0o700)
-		if err != nil {
-			fmt.Printf("Error creating directory %s: %s\n", dir, err)
-			continue
-		}
+// DefaultSkipResources is the default of Arguments.SkipResources.
+var DefaultSkipResources = []string{
+	"authentication.k8s.io/tokenreviews",
+	"authorization.k8s.io/localsubjectaccessreviews",
+	"authorization.k8s.io/subjectaccessreviews",
+	"authorization.k8s.io/selfsubjectrulesreviews",
+	"authorization.k8s.io/selfsubjectaccessreviews",
+	"core/componentstatuses",
+	"core/bindings",
+	"core/events", // exists twice. Second time with group events.k8s.io
+	"metallb.io/addresspools",
+	"coordination.k8s.io/leases", // Leases create too many modifications
+}
 
-		file := filepath.Join(dir, time.Now().UTC().Format(TimeFormat)+".log")
+// skipResource returns true if the resource should not be recorded.
+// If OnlyResources is not empty, SkipResources gets ignored.
+func (args *Arguments) skipResource(group, resource string) bool {
+	name := groupResourceName(group, resource)
 
-		err = os.WriteFile(file, []byte(line+"\n"), 0o600)
-		if err != nil {
-			fmt.Printf("Error writing log file %s: %s\n", file, err)
-			continue
-		}
+	if len(args.OnlyResources) > 0 {
+		return !matchesAny(args.OnlyResources, name)
+	}
+
+	return matchesAny(args.SkipResources, name)
+}
 
-		fmt.Printf("Created log file %s for pod %s/%s container %s\n", file, namespace, podName, containerName)
+// NamespaceSelected returns false if objects of this namespace should not be
+// recorded. Cluster-scoped objects (empty namespace) are always selected.
+func (args *Arguments) NamespaceSelected(namespace string) bool {
+	if namespace == "" {
+		return true
 	}
 
-	err = scanner.Err()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading logs for %s/%s [%s]: %v\n", namespace, podName, containerName, err)
+	if slices.Contains(args.ExcludeNamespaces, namespace) {
+		return false
 	}
-}
 
-func createRecorders(ctx context.Context, wg *sync.WaitGroup, serverResources []*metav1.APIResourceList, args Arguments, dynClient *dynamic.DynamicClient, host string) error {
-	baseDir := filepath.Join(args.OutputDirectory, host)
+	return len(args.Namespaces) == 0 || slices.Contains(args.Namespaces, namespace)
+}
 
-	err := os.MkdirAll(baseDir, 0o700)
-	if err != nil {
-		return fmt.Errorf("os.MkdirAll() failed: %w", err)
+// namespacesToList returns the namespaces to use for List and Watch of
+// namespaced resources.
+func (args *Arguments) namespacesToList() []string {
+	if len(args.Namespaces) == 0 {
+		return []string{metav1.NamespaceAll}
 	}
 
-	// the recordFile creates a marker file, so that the current time gets recorded.
-	// This is useful to find out when the recording started.
-	recordFile := filepath.Join(baseDir, "record-"+time.Now().UTC().Format(TimeFormat))
+	return args.Namespaces
+}
 
-	err = os.WriteFile(recordFile, []byte(""), 0o600)
-	if err != nil {
-		return fmt.Errorf("os.WriteFile() failed %q: %w", recordFile, err)
+// namespaceFilterActive returns true if not all namespaces get recorded.
+func (args *Arguments) namespaceFilterActive() bool {
+	return len(args.Namespaces) > 0 || len(args.ExcludeNamespaces) > 0
+}
+
+// listOptions returns the selectors for the resource. The first matching
+// entry of Selectors wins.
+func (args *Arguments) listOptions(group, resource string) metav1.ListOptions {
+	name := groupResourceName(group, resource)
+
+	for _, s := range args.Selectors {
+		if matchesAny([]string{s.Resource}, name) {
+			return metav1.ListOptions{
+				LabelSelector: s.LabelSelector,
+				FieldSelector: s.FieldSelector,
+			}
+		}
+	}
+
+	return metav1.ListOptions{
+		LabelSelector: args.LabelSelector,
+		FieldSelector: args.FieldSelector,
 	}
+}
 
-	for _, resourceList := range serverResources {
-		groupVersion, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+func (args *Arguments) validateSelectors() error {
+	selectors := append([]ResourceSelector{{
+		Resource:      "*/*",
+		LabelSelector: args.LabelSelector,
+		FieldSelector: args.FieldSelector,
+	}}, args.Selectors...)
+
+	for _, s := range selectors {
+		err := validateResourcePatterns([]string{s.Resource})
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to parse group version: %v\n", err)
-			continue
+			return err
 		}
 
-		for i := range resourceList.APIResources {
-			resourceName := resourceList.APIResources[i].Name
-			if slices.Contains(resourcesToSkip, groupResource{groupVersion.Group, resourceName}) {
-				continue
-			}
+		_, err = labels.Parse(s.LabelSelector)
+		if err != nil {
+			return fmt.Errorf("invalid label selector %q: %w", s.LabelSelector, err)
+		}
 
-			wg.Add(1)
-			go watchGVR(ctx, wg, &args, dynClient, schema.GroupVersionResource{
-				Group:    groupVersion.Group,
-				Version:  groupVersion.Version,
-				Resource: resourceName,
-			}, host, resourceList.APIResources[i].Namespaced)
+		_, err = fields.ParseSelector(s.FieldSelector)
+		if err != nil {
+			return fmt.Errorf("invalid field selector %q: %w", s.FieldSelector, err)
 		}
 	}
 
 	return nil
 }
 
-type groupResource struct {
-	group    string
-	resource string
+// groupResourceName returns group/resource. The empty core group is called "core".
+func groupResourceName(group, resource string) string {
+	if group == "" {
+		group = "core"
+	}
+
+	return group + "/" + resource
 }
 
-var resourcesToSkip = []groupResource{
-	{"authentication.k8s.io", "tokenreviews"},
-	{groupAuthorization, "localsubjectaccessreviews"},
-	{groupAuthorization, "subjectaccessreviews"},
-	{groupAuthorization, "selfsubjectrulesreviews"},
-	{groupAuthorization, "selfsubjectaccessreviews"},
-	{"", "componentstatuses"},
-	{"", "bindings"},
-	{"", "events"}, // exists twice. Second time with group events.k8s.io
-	{"metallb.io", "addresspools"},
-	{"coordination.k8s.io", "leases"}, // Leases create too many modifications
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		// Patterns were checked by validateResourcePatterns, so no error can happen.
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validateResourcePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("invalid resource pattern %q: %w", pattern, err)
+		}
+
+		if !strings.Contains(pattern, "/") {
+			return fmt.Errorf("invalid resource pattern %q: expected group/resource", pattern)
+		}
+	}
+
+	return nil
 }
 
 // watchGVR is called as Goroutine. It prints errors.
-func watchGVR(ctx context.Context, wg *sync.WaitGroup, args *Arguments, dynClient *dynamic.DynamicClient, gvr schema.GroupVersionResource, host string, namespaced bool) {
+//
+// The initial state gets fetched with a List. Afterwards the watch gets
+// resumed at the last seen resourceVersion whenever the server closes it.
+// If the resourceVersion is too old (410 Gone), the resource gets listed
+// again, and the result gets reconciled with the objects seen so far.
+func watchGVR(ctx context.Context, wg *sync.WaitGroup, args *Arguments, dynClient *dynamic.DynamicClient, gvr schema.GroupVersionResource, store Store, namespaced bool) {
 	defer wg.Done()
 
 	fmt.Printf("Watching %q %q\n", gvr.Group, gvr.Resource)
 
-	ri := dynClient.Resource(gvr)
+	args.Stats.watcherStarted()
+	defer args.Stats.watcherStopped()
+
+	listOptions := args.listOptions(gvr.Group, gvr.Resource)
+
+	filter := newUnchangedFilter(args.ignorePaths)
+
+	onEvent := func(event watch.Event, initialList bool) error {
+		obj, ok := event.Object.(*unstructured.Unstructured)
+		if ok && !args.NamespaceSelected(obj.GetNamespace()) {
+			return nil
+		}
+
+		if ok && !args.KeepUnchanged && filter.unchanged(event.Type, obj) {
+			args.Stats.versionDropped(gvr.Group, gvr.Resource)
+			return nil
+		}
 
-	var watchInterface interface {
-		Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error)
+		return handleEvent(args, store, gvr, event, initialList)
 	}
 
-	if namespaced && args.Namespace != "" {
-		watchInterface = ri.Namespace(args.Namespace)
-	} else {
-		watchInterface = ri
+	namespaces := []string{metav1.NamespaceAll}
+	if namespaced {
+		namespaces = args.namespacesToList()
 	}
 
-	watch, err := watchInterface.Watch(ctx, metav1.ListOptions{})
-	if err != nil {
-		fmt.Printf("..Error watching %v. group %q version %q resource %q\n", err,
-			gvr.Group, gvr.Version, gvr.Resource)
+	// One watch per namespace.
+	var namespaceWG sync.WaitGroup
+
+	for _, namespace := range namespaces {
+		w := newGVRWatcher(dynClient, gvr, namespace, listOptions, onEvent)
 
-		return
+		namespaceWG.Add(1)
+
+		go func() {
+			defer namespaceWG.Done()
+			w.run(ctx)
+		}()
 	}
-	defer watch.Stop()
+
+	namespaceWG.Wait()
+
+	if filter.dropped > 0 {
+		fmt.Printf("Dropped %d unchanged versions of %q %q\n", filter.dropped, gvr.Group, gvr.Resource)
+	}
+}
+
+// newGVRWatcher creates a watcher for the resource in the namespace. An empty
+// namespace means all namespaces.
+func newGVRWatcher(dynClient dynamic.Interface, gvr schema.GroupVersionResource, namespace string, listOptions metav1.ListOptions, onEvent func(event watch.Event, initialList bool) error) *gvrWatcher {
+	var client dynamic.ResourceInterface = dynClient.Resource(gvr)
+	if namespace != metav1.NamespaceAll {
+		client = dynClient.Resource(gvr).Namespace(namespace)
+	}
+
+	return &gvrWatcher{
+		client:      client,
+		gvr:         gvr,
+		listOptions: listOptions,
+		onEvent:     onEvent,
+		known:       make(map[string]*unstructured.Unstructured),
+	}
+}
+
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+// gvrWatcher holds the state of a single resource watch.
+type gvrWatcher struct {
+	client dynamic.ResourceInterface
+	gvr    schema.GroupVersionResource
+
+	// listOptions contains the selectors used for List and Watch.
+	listOptions metav1.ListOptions
+
+	// onEvent gets called for each added, modified or deleted object.
+	// initialList is true for the objects of the first List.
+	onEvent func(event watch.Event, initialList bool) error
+
+	// listed is true after the first List was done.
+	listed bool
+
+	// resourceVersion is the point to resume the watch. Empty means a (re-)list is needed.
+	resourceVersion string
+
+	// known contains the last seen state of each object. Key is namespace/name.
+	known map[string]*unstructured.Unstructured
+}
+
+func (w *gvrWatcher) run(ctx context.Context) {
+	delay := minRetryDelay
+
+	for ctx.Err() == nil {
+		if w.resourceVersion == "" {
+			err := w.relist(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				if isPermanentWatchError(err) {
+					fmt.Printf("..Error listing %v. group %q version %q resource %q\n", err,
+						w.gvr.Group, w.gvr.Version, w.gvr.Resource)
+
+					return
+				}
+
+				fmt.Printf("Error listing %q %q, retrying in %s: %v\n", w.gvr.Group, w.gvr.Resource, delay, err)
+
+				if !sleepWithContext(ctx, delay) {
+					return
+				}
+
+				delay = min(2*delay, maxRetryDelay)
+
+				continue
+			}
+		}
+
+		opts := w.listOptions
+		opts.ResourceVersion = w.resourceVersion
+		opts.AllowWatchBookmarks = true
+
+		watcher, err := w.client.Watch(ctx, opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			if apierrors.IsGone(err) || apierrors.IsResourceExpired(err) {
+				fmt.Printf("ResourceVersion %s of %q %q is too old, listing again\n",
+					w.resourceVersion, w.gvr.Group, w.gvr.Resource)
+
+				w.resourceVersion = ""
+
+				continue
+			}
+
+			if isPermanentWatchError(err) {
+				fmt.Printf("..Error watching %v. group %q version %q resource %q\n", err,
+					w.gvr.Group, w.gvr.Version, w.gvr.Resource)
+
+				return
+			}
+
+			fmt.Printf("Error watching %q %q, retrying in %s: %v\n", w.gvr.Group, w.gvr.Resource, delay, err)
+
+			if !sleepWithContext(ctx, delay) {
+				return
+			}
+
+			delay = min(2*delay, maxRetryDelay)
+
+			continue
+		}
+
+		received := w.consume(ctx, watcher)
+		watcher.Stop()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if received {
+			delay = minRetryDelay
+
+			fmt.Printf("Watch of %q %q was closed, resuming at resourceVersion %q\n",
+				w.gvr.Group, w.gvr.Resource, w.resourceVersion)
+
+			continue
+		}
+
+		// The watch was closed without any event. Don't hammer the API server.
+		fmt.Printf("Watch of %q %q was closed without events, resuming in %s\n",
+			w.gvr.Group, w.gvr.Resource, delay)
+
+		if !sleepWithContext(ctx, delay) {
+			return
+		}
+
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// consume handles the events of the watch until the watch gets closed.
+// It returns true if at least one event was received.
+func (w *gvrWatcher) consume(ctx context.Context, watcher watch.Interface) bool {
+	received := false
 
 	for {
 		select {
-		case event, ok := <-watch.ResultChan():
+		case event, ok := <-watcher.ResultChan():
 			if !ok {
-				// If there are not objects in a resource, the watch gets closed.
-				return
+				return received
 			}
 
-			err := handleEvent(args, gvr, event, host)
-			if err != nil {
-				fmt.Printf("Error handling event: %v\n", err)
+			received = true
+
+			switch event.Type {
+			case watch.Bookmark:
+				obj, ok := event.Object.(*unstructured.Unstructured)
+				if ok {
+					w.resourceVersion = obj.GetResourceVersion()
+				}
+			case watch.Error:
+				err := apierrors.FromObject(event.Object)
+				if apierrors.IsGone(err) || apierrors.IsResourceExpired(err) {
+					fmt.Printf("ResourceVersion %s of %q %q is too old, listing again\n",
+						w.resourceVersion, w.gvr.Group, w.gvr.Resource)
+
+					w.resourceVersion = ""
+
+					return received
+				}
+
+				fmt.Printf("Error event while watching %q %q: %v\n", w.gvr.Group, w.gvr.Resource, err)
+			default:
+				err := w.onEvent(event, false)
+				if err != nil {
+					fmt.Printf("Error handling event: %v\n", err)
+				}
+
+				obj, ok := event.Object.(*unstructured.Unstructured)
+				if !ok {
+					continue
+				}
+
+				w.resourceVersion = obj.GetResourceVersion()
+
+				if event.Type == watch.Deleted {
+					delete(w.known, objectKey(obj))
+				} else {
+					w.known[objectKey(obj)] = obj
+				}
 			}
 		case <-ctx.Done():
-			return
+			return received
+		}
+	}
+}
+
+// relist fetches the current state, and records all changes compared to the
+// objects known so far. Objects which vanished get recorded as deleted.
+func (w *gvrWatcher) relist(ctx context.Context) error {
+	list, err := w.client.List(ctx, w.listOptions)
+	if err != nil {
+		return fmt.Errorf("List() failed: %w", err)
+	}
+
+	seen := make(map[string]bool, len(list.Items))
+
+	for i := range list.Items {
+		obj := &list.Items[i]
+		key := objectKey(obj)
+		seen[key] = true
+
+		eventType := watch.Added
+
+		old, found := w.known[key]
+		if found {
+			if old.GetResourceVersion() == obj.GetResourceVersion() {
+				continue
+			}
+
+			eventType = watch.Modified
 		}
+
+		err := w.onEvent(watch.Event{Type: eventType, Object: obj}, !w.listed)
+		if err != nil {
+			fmt.Printf("Error handling event: %v\n", err)
+		}
+
+		w.known[key] = obj
+	}
+
+	for key, obj := range w.known {
+		if seen[key] {
+			continue
+		}
+
+		err := w.onEvent(watch.Event{Type: watch.Deleted, Object: obj}, false)
+		if err != nil {
+			fmt.Printf("Error handling event: %v\n", err)
+		}
+
+		delete(w.known, key)
+	}
+
+	w.resourceVersion = list.GetResourceVersion()
+	w.listed = true
+
+	return nil
+}
+
+// isPermanentWatchError returns true for errors where retrying is pointless.
+func isPermanentWatchError(err error) bool {
+	return apierrors.IsMethodNotSupported(err) ||
+		apierrors.IsBadRequest(err) ||
+		apierrors.IsForbidden(err) ||
+		apierrors.IsNotFound(err)
+}
+
+func objectKey(obj *unstructured.Unstructured) string {
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// sleepWithContext waits for the given duration. It returns false if the context was cancelled.
+func sleepWithContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
-func handleEvent(args *Arguments, gvr schema.GroupVersionResource, event watch.Event, host string) error {
+func handleEvent(args *Arguments, store Store, gvr schema.GroupVersionResource, event watch.Event, initialList bool) error {
 	if event.Object == nil {
 		return fmt.Errorf("event.Object is nil? Skipping this event. Type=%s %+v gvr: (group=%s version=%s resource=%s)", event.Type, event,
 			gvr.Group, gvr.Version, gvr.Resource)
@@ -314,16 +760,27 @@ func handleEvent(args *Arguments, gvr schema.GroupVersionResource, event watch.E
 	}
 
 	switch event.Type {
-	case watch.Modified, watch.Added, watch.Deleted, watch.Bookmark, watch.Error:
+	case watch.Modified, watch.Added, watch.Deleted:
 		fmt.Printf("%s %s %s/%s\n", event.Type, gvk.Kind,
 			getString(obj, "metadata", "namespace"),
 			getString(obj, "metadata", "name"),
 		)
 
-		err := storeResource(args, gvk.Group, gvk.Kind, obj, host)
+		err := storeResource(args, store, gvk.Group, gvk.Kind, obj, VersionMeta{
+			EventType:       event.Type,
+			ResourceVersion: obj.GetResourceVersion(),
+			UID:             string(obj.GetUID()),
+			InitialList:     initialList,
+			Sequence:        nextSequence(),
+			Observed:        time.Now().UTC(),
+		})
 		if err != nil {
 			return fmt.Errorf("error storing resource: %w", err)
 		}
+
+		if args.Until != nil && event.Type != watch.Deleted {
+			args.Until.check(obj)
+		}
 	default:
 		fmt.Printf("Internal Error, unknown event %s %+v %s\n", event.Type, gvk, event.Object)
 	}
@@ -331,63 +788,43 @@ func handleEvent(args *Arguments, gvr schema.GroupVersionResource, event watch.E
 	return nil
 }
 
-func redactSecret(obj *unstructured.Unstructured) {
-	for _, key := range []string{"data", "stringData"} {
-		m, found, err := unstructured.NestedStringMap(obj.Object, key)
-		if !found || err != nil {
-			continue
-		}
-
-		for k, v := range m {
-			if v == "" {
-				continue
-			}
-
-			m[k] = fmt.Sprintf("redacted-to-sha256:%x", sha256.Sum256([]byte(v)))
-		}
-
-		err = unstructured.SetNestedStringMap(obj.Object, m, key)
-		if err != nil {
-			continue
-		}
-	}
-}
-
-func storeResource(args *Arguments, group string, kind string, obj *unstructured.Unstructured, host string) error {
-	if group == "" && kind == "Secret" {
-		redactSecret(obj)
-	}
-
-	bytes, err := yaml.Marshal(obj)
-	if err != nil {
-		return fmt.Errorf("yaml.Marshal(obj) failed: %w", err)
-	}
+// storeResource redacts a copy of the object, and passes it to the store. For
+// deleted objects a tombstone gets stored, which contains the last known state
+// of the object. obj is not modified, because the watcher keeps it to create a
+// tombstone later.
+func storeResource(args *Arguments, store Store, group string, kind string, obj *unstructured.Unstructured, meta VersionMeta) error {
+	obj = obj.DeepCopy()
+	args.redactor.redact(obj)
 
 	name := getString(obj, "metadata", "name")
 	if name == "" {
 		return fmt.Errorf("obj has no name? %+v", obj)
 	}
 
-	ns := getString(obj, "metadata", "namespace")
-
 	if group == "" {
 		group = "core"
 	}
 
-	dir := filepath.Join(args.OutputDirectory, host, group, kind, ns, name)
-
-	err = os.MkdirAll(dir, 0o700)
-	if err != nil {
-		return fmt.Errorf("os.MkdirAll() failed: %w", err)
+	ref := ObjectRef{
+		Group:     group,
+		Kind:      kind,
+		Namespace: getString(obj, "metadata", "namespace"),
+		Name:      name,
 	}
 
-	file := filepath.Join(dir, time.Now().UTC().Format(TimeFormat)+".yaml")
+	var err error
+	if meta.EventType == watch.Deleted {
+		err = store.PutTombstone(ref, meta, obj)
+	} else {
+		err = store.PutVersion(ref, meta, obj)
+	}
 
-	err = os.WriteFile(file, bytes, 0o600)
 	if err != nil {
-		return fmt.Errorf("os.WriteFile() failed: %w", err)
+		return err
 	}
 
+	args.Stats.versionStored()
+
 	return nil
 }
 
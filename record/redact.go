@@ -0,0 +1,398 @@
+package record
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// RedactionAction is what happens to a value matched by a RedactionRule.
+type RedactionAction string
+
+const (
+	// RedactHash replaces the value by its HMAC. Changes of the value, and
+	// equal values, are still visible.
+	RedactHash RedactionAction = "hash"
+
+	// RedactDrop removes the value.
+	RedactDrop RedactionAction = "drop"
+
+	// RedactMask replaces the value by MaskedValue.
+	RedactMask RedactionAction = "mask"
+)
+
+// MaskedValue replaces values of RedactMask rules.
+const MaskedValue = "redacted"
+
+// RedactionRule selects values of objects which must not be stored.
+type RedactionRule struct {
+	// Group, Version and Kind are glob patterns (see path.Match). Empty
+	// matches all. The group of core resources is "core".
+	Group   string `json:"group,omitempty"`
+	Version string `json:"version,omitempty"`
+	Kind    string `json:"kind,omitempty"`
+
+	// Path is a JSONPath like "spec.containers[*].env[*]". Supported are
+	// fields, [*] for all items of a list, and * for all fields of a map. Dots
+	// in field names get escaped with a backslash.
+	Path string `json:"path"`
+
+	// Keys is a regular expression. If Path selects a map, the values of the
+	// matching keys get redacted. Empty matches all keys.
+	Keys string `json:"keys,omitempty"`
+
+	Action RedactionAction `json:"action"`
+}
+
+// DefaultRedactionRules hash the data of Secrets. They get applied before the
+// rules of Arguments.RedactionRules.
+var DefaultRedactionRules = []RedactionRule{
+	{Group: "core", Kind: "Secret", Path: "data", Action: RedactHash},
+	{Group: "core", Kind: "Secret", Path: "stringData", Action: RedactHash},
+}
+
+// RedactionRulesFile is the content of the file given by `record --redaction-rules`.
+type RedactionRulesFile struct {
+	Rules []RedactionRule `json:"rules"`
+}
+
+// LoadRedactionRules reads a YAML file with redaction rules. Unknown fields are an error.
+func LoadRedactionRules(file string) ([]RedactionRule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile() failed: %w", err)
+	}
+
+	var rulesFile RedactionRulesFile
+
+	err = yaml.UnmarshalStrict(data, &rulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q failed: %w", file, err)
+	}
+
+	return rulesFile.Rules, nil
+}
+
+// pathElement is a field of RedactionRule.Path.
+type pathElement struct {
+	field string
+
+	// list is true for "field[*]".
+	list bool
+}
+
+type redactionRule struct {
+	RedactionRule
+
+	path []pathElement
+	keys *regexp.Regexp
+}
+
+func compileRedactionRules(rules []RedactionRule) ([]redactionRule, error) {
+	compiled := make([]redactionRule, 0, len(rules))
+
+	for _, rule := range rules {
+		switch rule.Action {
+		case RedactHash, RedactDrop, RedactMask:
+		default:
+			return nil, fmt.Errorf("invalid action %q of redaction rule for path %q. Valid values: hash, drop, mask", rule.Action, rule.Path)
+		}
+
+		for _, pattern := range []string{rule.Group, rule.Version, rule.Kind} {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q of redaction rule for path %q: %w", pattern, rule.Path, err)
+			}
+		}
+
+		elements, err := parseRedactionPath(rule.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		keys, err := regexp.Compile(rule.Keys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keys %q of redaction rule for path %q: %w", rule.Keys, rule.Path, err)
+		}
+
+		compiled = append(compiled, redactionRule{RedactionRule: rule, path: elements, keys: keys})
+	}
+
+	return compiled, nil
+}
+
+// parseRedactionPath parses RedactionRule.Path. The JSONPath forms
+// "{.spec.foo}" and "$.spec.foo" get accepted, too.
+func parseRedactionPath(s string) ([]pathElement, error) {
+	p := strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	p = strings.TrimPrefix(strings.TrimPrefix(p, "$"), ".")
+
+	fields, err := ParseIgnorePath(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path of redaction rule: %w", err)
+	}
+
+	elements := make([]pathElement, 0, len(fields))
+
+	for _, field := range fields {
+		field, list := strings.CutSuffix(field, "[*]")
+		if field == "" || strings.ContainsAny(field, "[]") {
+			return nil, fmt.Errorf("invalid path of redaction rule %q: only fields, [*] and * are supported", s)
+		}
+
+		elements = append(elements, pathElement{field: field, list: list})
+	}
+
+	return elements, nil
+}
+
+func (r *redactionRule) matches(gvk schema.GroupVersionKind) bool {
+	group := gvk.Group
+	if group == "" {
+		group = "core"
+	}
+
+	return globMatch(r.Group, group) && globMatch(r.Version, gvk.Version) && globMatch(r.Kind, gvk.Kind)
+}
+
+// globMatch returns true if name matches the pattern. An empty pattern matches all.
+func globMatch(pattern, name string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	matched, _ := path.Match(pattern, name)
+
+	return matched
+}
+
+// embeddedObjectAnnotations contain a copy of the object as JSON. The copy
+// gets redacted with the same rules. managedFields contain only field names,
+// no values.
+var embeddedObjectAnnotations = []string{
+	"kubectl.kubernetes.io/last-applied-configuration",
+}
+
+// redactor applies redaction rules. Hashes are HMACs with the key, so that
+// values with low entropy can't be found by brute force without the key.
+type redactor struct {
+	rules []redactionRule
+	key   []byte
+}
+
+func newRedactor(rules []RedactionRule, key []byte) (*redactor, error) {
+	compiled, err := compileRedactionRules(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redactor{rules: compiled, key: key}, nil
+}
+
+// redact applies the rules to obj, and to the copies of obj in
+// embeddedObjectAnnotations. obj gets modified.
+func (r *redactor) redact(obj *unstructured.Unstructured) {
+	r.redactEmbeddedObjects(obj)
+
+	gvk := obj.GroupVersionKind()
+
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if !rule.matches(gvk) {
+			continue
+		}
+
+		root := map[string]any{"": obj.Object}
+		rule.walk(root, "", rule.path, r.hashValue)
+	}
+}
+
+// redactEmbeddedObjects redacts the copies of obj in annotations. An
+// annotation which can't be parsed gets removed, because it is unknown
+// whether it contains secrets.
+func (r *redactor) redactEmbeddedObjects(obj *unstructured.Unstructured) {
+	annotations := obj.GetAnnotations()
+	changed := false
+
+	for _, key := range embeddedObjectAnnotations {
+		value, found := annotations[key]
+		if !found {
+			continue
+		}
+
+		changed = true
+		embedded := &unstructured.Unstructured{}
+
+		err := embedded.UnmarshalJSON([]byte(value))
+		if err != nil {
+			delete(annotations, key)
+			continue
+		}
+
+		r.redact(embedded)
+
+		data, err := embedded.MarshalJSON()
+		if err != nil {
+			delete(annotations, key)
+			continue
+		}
+
+		annotations[key] = string(data)
+	}
+
+	if changed {
+		obj.SetAnnotations(annotations)
+	}
+}
+
+// walk follows the remaining path elements, starting at parent[key].
+func (r *redactionRule) walk(parent map[string]any, key string, elements []pathElement, hash func(value any) any) {
+	value, found := parent[key]
+	if !found {
+		return
+	}
+
+	if len(elements) == 0 {
+		m, ok := value.(map[string]any)
+		if !ok {
+			r.apply(parent, key, hash)
+			return
+		}
+
+		for k := range m {
+			if r.keys.MatchString(k) {
+				r.apply(m, k, hash)
+			}
+		}
+
+		return
+	}
+
+	m, ok := value.(map[string]any)
+	if !ok {
+		return
+	}
+
+	element := elements[0]
+
+	fields := []string{element.field}
+	if element.field == "*" {
+		fields = make([]string, 0, len(m))
+		for k := range m {
+			fields = append(fields, k)
+		}
+	}
+
+	for _, field := range fields {
+		if !element.list {
+			r.walk(m, field, elements[1:], hash)
+			continue
+		}
+
+		list, ok := m[field].([]any)
+		if !ok {
+			continue
+		}
+
+		kept := list[:0]
+
+		for _, item := range list {
+			// A map with a single entry, so that items can be replaced and dropped.
+			holder := map[string]any{"": item}
+			r.walk(holder, "", elements[1:], hash)
+
+			if item, found := holder[""]; found {
+				kept = append(kept, item)
+			}
+		}
+
+		m[field] = kept
+	}
+}
+
+// apply redacts m[key] according to the action of the rule.
+func (r *redactionRule) apply(m map[string]any, key string, hash func(value any) any) {
+	switch r.Action {
+	case RedactDrop:
+		delete(m, key)
+	case RedactMask:
+		m[key] = MaskedValue
+	case RedactHash:
+		m[key] = hash(m[key])
+	}
+}
+
+// hashValue returns the HMAC of a value. Empty strings stay empty, so that
+// it is still visible that there is no value.
+func (r *redactor) hashValue(value any) any {
+	s, ok := value.(string)
+	if !ok {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return MaskedValue
+		}
+
+		s = string(data)
+	}
+
+	if s == "" {
+		return s
+	}
+
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(s))
+
+	return fmt.Sprintf("redacted-to-hmac-sha256:%x", mac.Sum(nil))
+}
+
+// minRedactionKeyLength is the minimal length of a key given by the user.
+const minRedactionKeyLength = 16
+
+// NewRedactionKey returns a random key. It gets used if the user gives no key.
+func NewRedactionKey() ([]byte, error) {
+	key := make([]byte, 32)
+
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("rand.Read() failed: %w", err)
+	}
+
+	return key, nil
+}
+
+// LoadRedactionKey reads a key from a file. Leading and trailing white space
+// gets ignored.
+func LoadRedactionKey(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile() failed: %w", err)
+	}
+
+	key := bytes.TrimSpace(data)
+	if len(key) < minRedactionKeyLength {
+		return nil, fmt.Errorf("the key in %q is too short. At least %d bytes are needed", file, minRedactionKeyLength)
+	}
+
+	return key, nil
+}
+
+// RedactionKeyID identifies a key without revealing it. Recordings with the
+// same key ID have comparable hashes.
+func RedactionKeyID(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("watchall-redaction-key-id"))
+
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
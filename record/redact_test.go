@@ -0,0 +1,255 @@
+package record
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const plaintextSecret = "s3cr3t-p4ssw0rd"
+
+// newAppliedSecret returns a Secret like it gets created by `kubectl apply`:
+// the data is in the last-applied-configuration annotation, too.
+func newAppliedSecret(t *testing.T) *unstructured.Unstructured {
+	t.Helper()
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(plaintextSecret))
+
+	applied, err := json.Marshal(map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]any{"name": "db", "namespace": "default"},
+		"data":       map[string]any{"password": encoded},
+		"stringData": map[string]any{"plain": plaintextSecret},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]any{
+			"name":            "db",
+			"namespace":       "default",
+			"resourceVersion": "1",
+			"annotations": map[string]any{
+				"kubectl.kubernetes.io/last-applied-configuration": string(applied),
+			},
+		},
+		"data": map[string]any{"password": encoded},
+	}}
+}
+
+func newTestRedactor(t *testing.T) *redactor {
+	t.Helper()
+
+	r, err := newRedactor(DefaultRedactionRules, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+// assertNoSecret fails if data contains the secret, plain or base64 encoded.
+func assertNoSecret(t *testing.T, name string, data []byte) {
+	t.Helper()
+
+	for _, s := range []string{plaintextSecret, base64.StdEncoding.EncodeToString([]byte(plaintextSecret))} {
+		if bytes.Contains(data, []byte(s)) {
+			t.Errorf("%s contains %q:\n%s", name, s, data)
+		}
+	}
+}
+
+func TestRedactLastAppliedConfiguration(t *testing.T) {
+	obj := newAppliedSecret(t)
+
+	newTestRedactor(t).redact(obj)
+
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertNoSecret(t, "redacted object", data)
+
+	// The annotation is still there, so changes of it are visible.
+	applied, found := obj.GetAnnotations()["kubectl.kubernetes.io/last-applied-configuration"]
+	if !found {
+		t.Fatal("last-applied-configuration was removed")
+	}
+
+	embedded := &unstructured.Unstructured{}
+
+	err = embedded.UnmarshalJSON([]byte(applied))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same value has the same hash in the object and in the annotation.
+	want, _, _ := unstructured.NestedString(obj.Object, "data", "password")
+	got, _, _ := unstructured.NestedString(embedded.Object, "data", "password")
+
+	if got != want {
+		t.Errorf("hash in annotation %q differs from hash in data %q", got, want)
+	}
+}
+
+func TestRedactInvalidLastAppliedConfiguration(t *testing.T) {
+	obj := newAppliedSecret(t)
+	obj.SetAnnotations(map[string]string{
+		"kubectl.kubernetes.io/last-applied-configuration": `{"data":{"password":"` + plaintextSecret + `"`,
+	})
+
+	newTestRedactor(t).redact(obj)
+
+	if _, found := obj.GetAnnotations()["kubectl.kubernetes.io/last-applied-configuration"]; found {
+		t.Error("an annotation which can't be parsed must be removed")
+	}
+}
+
+func TestRedactedSecretOnDisk(t *testing.T) {
+	for _, newStore := range map[string]StoreFactory{
+		"dir":     NewDirStore,
+		"delta":   DirStoreFactory(StoreOptions{KeyframeInterval: 3}),
+		"journal": JournalStoreFactory(DefaultJournalSegmentSize, StoreOptions{}),
+	} {
+		baseDir := t.TempDir()
+
+		store, err := newStore(baseDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		args := &Arguments{redactor: newTestRedactor(t)}
+		now := time.Now()
+
+		err = store.StartSession(SessionInfo{Start: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, eventType := range []watch.EventType{watch.Added, watch.Modified, watch.Deleted} {
+			obj := newAppliedSecret(t)
+
+			err := storeResource(args, store, "", "Secret", obj, VersionMeta{
+				EventType: eventType,
+				Sequence:  uint64(i + 1),
+				Observed:  now,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = store.EndSession(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = filepath.WalkDir(baseDir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			assertNoSecret(t, path, data)
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestStoreResourceRedactsCopy stores the same object twice, like a tombstone
+// after a relist. The object must not be redacted twice.
+func TestStoreResourceRedactsCopy(t *testing.T) {
+	baseDir := t.TempDir()
+
+	store, err := NewDirStore(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := &Arguments{redactor: newTestRedactor(t)}
+	obj := newAppliedSecret(t)
+	now := time.Now()
+
+	for i, eventType := range []watch.EventType{watch.Added, watch.Deleted} {
+		err := storeResource(args, store, "", "Secret", obj, VersionMeta{
+			EventType: eventType,
+			Sequence:  uint64(i + 1),
+			Observed:  now,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := getString(obj, "data", "password"); got != base64.StdEncoding.EncodeToString([]byte(plaintextSecret)) {
+		t.Errorf("the object was modified: %q", got)
+	}
+
+	files, err := filepath.Glob(filepath.Join(baseDir, "core", "Secret", "default", "db", "*.yaml"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("got files %v: %v", files, err)
+	}
+
+	var hashes []string
+
+	for _, file := range files {
+		stored, err := ReadVersion(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hashes = append(hashes, getString(stored, "data", "password"))
+	}
+
+	if hashes[0] != hashes[1] {
+		t.Errorf("the tombstone has a different hash: %q != %q", hashes[1], hashes[0])
+	}
+}
+
+func TestRedactHashIsKeyed(t *testing.T) {
+	hash := func(key string) any {
+		r, err := newRedactor(DefaultRedactionRules, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return r.hashValue(plaintextSecret)
+	}
+
+	if hash("0123456789abcdef") != hash("0123456789abcdef") {
+		t.Error("equal values with the same key must have the same hash")
+	}
+
+	if hash("0123456789abcdef") == hash("fedcba9876543210") {
+		t.Error("the hash must depend on the key")
+	}
+
+	unkeyed := fmt.Sprintf("%x", sha256.Sum256([]byte(plaintextSecret)))
+	if strings.Contains(hash("0123456789abcdef").(string), unkeyed) {
+		t.Error("the hash must not be the plain sha256 of the value")
+	}
+}
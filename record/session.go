@@ -0,0 +1,150 @@
+package record
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SessionInfo describes a recording session. It gets stored as JSON in the
+// start marker.
+type SessionInfo struct {
+	Start time.Time `json:"start"`
+
+	// RedactionKeyID identifies the HMAC key of redacted values, see
+	// RedactionKeyID(). Hashes of sessions with the same key ID can be compared.
+	RedactionKeyID string `json:"redactionKeyID,omitempty"`
+}
+
+// writeStartMarker writes the start marker with the session info. Markers get
+// written by all stores, so that readers can find the sessions.
+func writeStartMarker(baseDir string, info SessionInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("json.Marshal() failed: %w", err)
+	}
+
+	return writeMarker(baseDir, StartMarkerPrefix, info.Start, append(data, '\n'))
+}
+
+// writeMarker creates the file BASEDIR/PREFIX-TIMESTAMP.
+func writeMarker(baseDir, prefix string, t time.Time, data []byte) error {
+	file := filepath.Join(baseDir, prefix+t.UTC().Format(TimeFormat))
+
+	err := os.WriteFile(file, data, 0o600)
+	if err != nil {
+		return fmt.Errorf("os.WriteFile() failed %q: %w", file, err)
+	}
+
+	return nil
+}
+
+// ReadSessionInfo reads the info of the session which started at
+// startTimestamp (TimeFormat). The markers of older recordings are empty. For
+// these an empty SessionInfo gets returned.
+func ReadSessionInfo(baseDir, startTimestamp string) (SessionInfo, error) {
+	var info SessionInfo
+
+	file := filepath.Join(baseDir, StartMarkerPrefix+startTimestamp)
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return info, nil
+		}
+
+		return info, fmt.Errorf("os.ReadFile() failed: %w", err)
+	}
+
+	if len(data) == 0 {
+		return info, nil
+	}
+
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return info, fmt.Errorf("invalid session info in %q: %w", file, err)
+	}
+
+	return info, nil
+}
+
+// maxObjectDirDepth is the maximal depth of an object directory below the
+// directory of the cluster: GROUP/KIND/NAMESPACE/NAME.
+const maxObjectDirDepth = 4
+
+// findSessionStarts returns the sorted timestamps (TimeFormat) of the start
+// markers of the cluster directory which contains dir. dir is the cluster
+// directory, or a directory below it. Recordings of older versions have no
+// markers. For these nil gets returned.
+func findSessionStarts(dir string) ([]string, error) {
+	dir = filepath.Clean(dir)
+
+	for range maxObjectDirDepth + 1 {
+		starts, err := sessionStarts(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(starts) > 0 {
+			return starts, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+
+		dir = parent
+	}
+
+	return nil, nil
+}
+
+// sessionStarts returns the sorted timestamps of the start markers in baseDir.
+func sessionStarts(baseDir string) ([]string, error) {
+	markers, err := filepath.Glob(filepath.Join(baseDir, StartMarkerPrefix+"*"))
+	if err != nil {
+		return nil, fmt.Errorf("filepath.Glob() failed: %w", err)
+	}
+
+	var starts []string
+
+	for _, marker := range markers {
+		name := filepath.Base(marker)
+		if strings.HasPrefix(name, EndMarkerPrefix) {
+			continue
+		}
+
+		start := strings.TrimPrefix(name, StartMarkerPrefix)
+
+		_, err := time.Parse(TimeFormat, start)
+		if err != nil {
+			continue
+		}
+
+		starts = append(starts, start)
+	}
+
+	slices.Sort(starts)
+
+	return starts, nil
+}
+
+// sessionIndex returns the number of sessions which started before the file
+// with the basename was written. The sequence numbers restart in each
+// session, so files of several sessions get ordered by session first.
+func sessionIndex(starts []string, baseName string) int {
+	timestamp := baseName[:min(len(baseName), len(TimeFormat))]
+
+	i, found := slices.BinarySearch(starts, timestamp)
+	if found {
+		i++
+	}
+
+	return i
+}
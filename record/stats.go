@@ -0,0 +1,91 @@
+package record
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Stats counts what a recording did. It is safe for concurrent use. A nil
+// *Stats is valid and counts nothing.
+type Stats struct {
+	watchers atomic.Int64
+	versions atomic.Int64
+	logLines atomic.Int64
+	dropped  atomic.Int64
+
+	mu sync.Mutex
+
+	// droppedByResource counts the dropped versions per group/resource.
+	droppedByResource map[string]int64
+}
+
+func (s *Stats) watcherStarted() {
+	if s != nil {
+		s.watchers.Add(1)
+	}
+}
+
+func (s *Stats) watcherStopped() {
+	if s != nil {
+		s.watchers.Add(-1)
+	}
+}
+
+func (s *Stats) versionStored() {
+	if s != nil {
+		s.versions.Add(1)
+	}
+}
+
+func (s *Stats) versionDropped(group, resource string) {
+	if s == nil {
+		return
+	}
+
+	s.dropped.Add(1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.droppedByResource == nil {
+		s.droppedByResource = make(map[string]int64)
+	}
+
+	s.droppedByResource[groupResourceName(group, resource)]++
+}
+
+func (s *Stats) logLineStored() {
+	if s != nil {
+		s.logLines.Add(1)
+	}
+}
+
+// String returns a short summary like "87 watchers, 1234 versions, 56 unchanged dropped, 10 log lines".
+func (s *Stats) String() string {
+	return fmt.Sprintf("%d watchers, %d versions, %d unchanged dropped, %d log lines",
+		s.watchers.Load(), s.versions.Load(), s.dropped.Load(), s.logLines.Load())
+}
+
+// DroppedString returns the resources with the most dropped unchanged
+// versions, like "core/events 120, apps/deployments 3". At most limit
+// resources get returned. It returns "" if nothing was dropped.
+func (s *Stats) DroppedString(limit int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := slices.SortedFunc(maps.Keys(s.droppedByResource), func(a, b string) int {
+		return cmp.Or(cmp.Compare(s.droppedByResource[b], s.droppedByResource[a]), strings.Compare(a, b))
+	})
+
+	parts := make([]string, 0, min(limit, len(names)))
+	for _, name := range names[:min(limit, len(names))] {
+		parts = append(parts, fmt.Sprintf("%s %d", name, s.droppedByResource[name]))
+	}
+
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,27 @@
+package record
+
+import "testing"
+
+func TestDroppedString(t *testing.T) {
+	var stats Stats
+
+	if got := stats.DroppedString(2); got != "" {
+		t.Errorf("got %q, want empty string", got)
+	}
+
+	for range 3 {
+		stats.versionDropped("", "events")
+	}
+
+	stats.versionDropped("apps", "deployments")
+	stats.versionDropped("apps", "replicasets")
+
+	want := "core/events 3, apps/deployments 1"
+	if got := stats.DroppedString(2); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := stats.String(); got != "0 watchers, 0 versions, 5 unchanged dropped, 0 log lines" {
+		t.Errorf("unexpected summary %q", got)
+	}
+}
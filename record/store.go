@@ -0,0 +1,112 @@
+package record
+
+import (
+	"time"
+
+	"filippo.io/age"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Store persists the recording of one cluster. The methods get called
+// concurrently, but never concurrently for the same object or container.
+type Store interface {
+	// StartSession gets called once, before anything else gets stored.
+	StartSession(info SessionInfo) error
+
+	// EndSession gets called once, after all versions and log lines were stored.
+	EndSession(t time.Time) error
+
+	// PutVersion stores a new version of an object.
+	PutVersion(ref ObjectRef, meta VersionMeta, obj *unstructured.Unstructured) error
+
+	// PutTombstone stores the last known state of a deleted object.
+	PutTombstone(ref ObjectRef, meta VersionMeta, obj *unstructured.Unstructured) error
+
+	// AppendLogLine stores a line of the log of a container instance.
+	AppendLogLine(line LogLine) error
+
+	// AppendLogGap stores a time span in which lines of the log of a container
+	// instance may be missing.
+	AppendLogGap(gap LogGap) error
+
+	// CloseLog gets called when the log stream of a container instance ended.
+	// No more lines of it get appended.
+	CloseLog(ref ContainerRef) error
+}
+
+// StoreFactory creates the Store of a cluster. baseDir is the directory of
+// the cluster below Arguments.OutputDirectory.
+type StoreFactory func(baseDir string) (Store, error)
+
+// StoreOptions configure the built-in stores.
+type StoreOptions struct {
+	// Compression gets applied to each file (DirStore), or to each segment (JournalStore).
+	Compression Compression
+
+	// KeyframeInterval > 0 lets DirStore write JSON merge patches instead of
+	// full versions. Every KeyframeInterval versions of an object a full
+	// version (keyframe) gets written.
+	KeyframeInterval int
+
+	// Recipients: if set, all files (DirStore) or segments (JournalStore)
+	// get encrypted with age after compression.
+	Recipients []age.Recipient
+}
+
+// ObjectRef identifies a stored object. Group is "core" for core resources.
+// Namespace is empty for cluster-scoped objects.
+type ObjectRef struct {
+	Group     string
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// ContainerRef identifies an instance of a container. A restarted container
+// is a new instance with a higher RestartCount.
+type ContainerRef struct {
+	Namespace    string `json:"namespace"`
+	Pod          string `json:"pod"`
+	PodUID       string `json:"podUID,omitempty"`
+	Container    string `json:"container"`
+	RestartCount int32  `json:"restartCount"`
+}
+
+// LogLine is a line of the log of a container instance.
+type LogLine struct {
+	ContainerRef
+
+	// Sequence orders all versions and log lines of a recording session.
+	Sequence uint64
+
+	// Observed is the time the recorder received the line.
+	Observed time.Time
+
+	// Timestamp is the time the container runtime received the line. Zero if
+	// the line had no timestamp.
+	Timestamp time.Time
+
+	Line string
+}
+
+// LogGap is a time span in which lines of the log of a container instance
+// may be missing, because the log stream was interrupted. The lines after
+// From were requested again, but the container runtime might have rotated
+// the log in the meantime.
+type LogGap struct {
+	ContainerRef
+
+	// Sequence orders all versions, log lines and gaps of a recording session.
+	Sequence uint64 `json:"sequence"`
+
+	// Observed is the time the recorder stored the gap.
+	Observed time.Time `json:"observed"`
+
+	// From is the timestamp of the last line before the gap. To is the time
+	// the stream was reconnected. Zero if it was not reconnected.
+	From time.Time `json:"from"`
+	To   time.Time `json:"to,omitzero"`
+
+	// Reason describes why the stream was interrupted.
+	Reason string `json:"reason"`
+}
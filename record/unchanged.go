@@ -0,0 +1,126 @@
+package record
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// StripIrrelevantFields removes fields which change often, but which do not
+// carry information about the state of the object.
+func StripIrrelevantFields(obj *unstructured.Unstructured) {
+	unstructured.RemoveNestedField(obj.Object, "metadata", "managedFields")
+	unstructured.RemoveNestedField(obj.Object, "metadata", "annotations", "kubectl.kubernetes.io/last-applied-configuration")
+	unstructured.RemoveNestedField(obj.Object, "metadata", "resourceVersion")
+	unstructured.RemoveNestedField(obj.Object, "metadata", "generation")
+	unstructured.RemoveNestedField(obj.Object, "metadata", "uid")
+}
+
+// ParseIgnorePath splits a dotted path like "status.observedGeneration" into
+// its fields. A dot which is part of a field name gets escaped with a
+// backslash: `metadata.annotations.example\.com/last-seen`.
+func ParseIgnorePath(s string) ([]string, error) {
+	var fields []string
+
+	var current strings.Builder
+
+	escaped := false
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '.':
+			fields = append(fields, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+
+	if escaped {
+		return nil, fmt.Errorf("invalid ignore path %q: trailing backslash", s)
+	}
+
+	fields = append(fields, current.String())
+
+	for _, field := range fields {
+		if field == "" {
+			return nil, fmt.Errorf("invalid ignore path %q: empty field", s)
+		}
+	}
+
+	return fields, nil
+}
+
+func parseIgnorePaths(paths []string) ([][]string, error) {
+	parsed := make([][]string, 0, len(paths))
+
+	for _, p := range paths {
+		fields, err := ParseIgnorePath(p)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed = append(parsed, fields)
+	}
+
+	return parsed, nil
+}
+
+// unchangedFilter remembers the last stored version of each object of one
+// resource, to drop versions which differ only in irrelevant fields. It is
+// shared by the watches of all namespaces.
+type unchangedFilter struct {
+	ignorePaths [][]string
+
+	mu      sync.Mutex
+	last    map[string]*unstructured.Unstructured
+	dropped int
+}
+
+func newUnchangedFilter(ignorePaths [][]string) *unchangedFilter {
+	return &unchangedFilter{
+		ignorePaths: ignorePaths,
+		last:        make(map[string]*unstructured.Unstructured),
+	}
+}
+
+// unchanged returns true if the event is a modification which is, after
+// normalization, equal to the last version of the object.
+func (f *unchangedFilter) unchanged(eventType watch.EventType, obj *unstructured.Unstructured) bool {
+	key := objectKey(obj)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if eventType == watch.Deleted {
+		delete(f.last, key)
+		return false
+	}
+
+	normalized := obj.DeepCopy()
+	StripIrrelevantFields(normalized)
+
+	for _, fields := range f.ignorePaths {
+		unstructured.RemoveNestedField(normalized.Object, fields...)
+	}
+
+	last, found := f.last[key]
+	if found && eventType == watch.Modified && equality.Semantic.DeepEqual(last.Object, normalized.Object) {
+		f.dropped++
+		return true
+	}
+
+	f.last[key] = normalized
+
+	return false
+}
@@ -0,0 +1,134 @@
+package record
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// UntilCondition stops a recording as soon as an object has a given value.
+// The syntax is "Kind/namespace/name path == value" (or "Kind/name" for
+// cluster-scoped objects). The path uses the JSONPath syntax of kubectl,
+// for example "Cluster/default/foo status.phase == Provisioned". The
+// operator "!=" is supported, too.
+type UntilCondition struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Path      string
+	Value     string
+	NotEqual  bool
+
+	mu       sync.Mutex
+	jsonPath *jsonpath.JSONPath
+	once     sync.Once
+	done     chan struct{}
+}
+
+// ParseUntilCondition parses the condition. See UntilCondition for the syntax.
+func ParseUntilCondition(condition string) (*UntilCondition, error) {
+	ref, expression, found := strings.Cut(strings.TrimSpace(condition), " ")
+	if !found {
+		return nil, fmt.Errorf("invalid condition %q, expected: Kind/namespace/name path == value", condition)
+	}
+
+	c := &UntilCondition{
+		done: make(chan struct{}),
+	}
+
+	parts := strings.Split(ref, "/")
+
+	switch len(parts) {
+	case 2:
+		c.Kind, c.Name = parts[0], parts[1]
+	case 3:
+		c.Kind, c.Namespace, c.Name = parts[0], parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("invalid object %q in condition, expected Kind/namespace/name or Kind/name", ref)
+	}
+
+	path, value, found := strings.Cut(expression, "!=")
+	if found {
+		c.NotEqual = true
+	} else {
+		path, value, found = strings.Cut(expression, "==")
+		if !found {
+			return nil, fmt.Errorf("invalid condition %q, expected == or !=", condition)
+		}
+	}
+
+	c.Path = strings.TrimSpace(path)
+	c.Value = strings.TrimSpace(value)
+
+	if unquoted, err := strconv.Unquote(c.Value); err == nil {
+		c.Value = unquoted
+	}
+
+	// Accept "status.phase", ".status.phase" and "{.status.phase}".
+	template := c.Path
+	if !strings.HasPrefix(template, "{") {
+		template = "{." + strings.TrimPrefix(template, ".") + "}"
+	}
+
+	c.jsonPath = jsonpath.New("until").AllowMissingKeys(true)
+
+	err := c.jsonPath.Parse(template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %q in condition: %w", c.Path, err)
+	}
+
+	return c, nil
+}
+
+// Done returns a channel which gets closed when the condition holds.
+func (c *UntilCondition) Done() <-chan struct{} {
+	return c.done
+}
+
+// String returns the condition in the syntax of ParseUntilCondition.
+func (c *UntilCondition) String() string {
+	ref := c.Kind + "/" + c.Name
+	if c.Namespace != "" {
+		ref = c.Kind + "/" + c.Namespace + "/" + c.Name
+	}
+
+	operator := "=="
+	if c.NotEqual {
+		operator = "!="
+	}
+
+	return fmt.Sprintf("%s %s %s %s", ref, c.Path, operator, c.Value)
+}
+
+// check closes the Done channel if obj is the object of the condition and
+// the condition holds.
+func (c *UntilCondition) check(obj *unstructured.Unstructured) {
+	if obj.GetKind() != c.Kind || obj.GetNamespace() != c.Namespace || obj.GetName() != c.Name {
+		return
+	}
+
+	var buf bytes.Buffer
+
+	// JSONPath is not safe for concurrent use.
+	c.mu.Lock()
+	err := c.jsonPath.Execute(&buf, obj.Object)
+	c.mu.Unlock()
+
+	if err != nil {
+		fmt.Printf("Error evaluating condition %q: %v\n", c.String(), err)
+		return
+	}
+
+	if (buf.String() == c.Value) == c.NotEqual {
+		return
+	}
+
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
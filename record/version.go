@@ -0,0 +1,170 @@
+package record
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"sigs.k8s.io/yaml"
+)
+
+// PatchSuffix is the suffix of files which contain a JSON merge patch against
+// the previous version of the object. See StoreOptions.KeyframeInterval.
+const PatchSuffix = ".patch.json"
+
+// IsVersionFile returns true if the basename is a stored version of an
+// object: a full version, a tombstone, or a patch. Compressed files are
+// supported.
+func IsVersionFile(baseName string) bool {
+	name := TrimCompressionSuffix(baseName)
+
+	return strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, PatchSuffix)
+}
+
+// IsPatchFile returns true if the basename is a version which is stored as patch.
+func IsPatchFile(baseName string) bool {
+	return strings.HasSuffix(TrimCompressionSuffix(baseName), PatchSuffix)
+}
+
+// ReadVersion reads a stored version of an object. Patches get applied to the
+// preceding keyframe in the same directory, so the full object gets returned.
+func ReadVersion(file string) (*unstructured.Unstructured, error) {
+	if !IsPatchFile(filepath.Base(file)) {
+		return readFullVersion(file)
+	}
+
+	dir := filepath.Dir(file)
+
+	chain, err := patchChainFiles(dir, filepath.Base(file))
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := readFullVersion(filepath.Join(dir, chain[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range chain[1:] {
+		data, err := ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		var patch map[string]any
+
+		err = utiljson.Unmarshal(data, &patch)
+		if err != nil {
+			return nil, fmt.Errorf("invalid patch %q: %w", filepath.Join(dir, name), err)
+		}
+
+		obj.Object, _ = applyMergePatch(obj.Object, patch).(map[string]any)
+	}
+
+	return obj, nil
+}
+
+// patchChainFiles returns the basenames of the keyframe which precedes the
+// patch, the patches in between, and the patch itself.
+func patchChainFiles(dir, patchName string) ([]string, error) {
+	versions, err := listVersions(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	end := slices.IndexFunc(versions, func(v storedVersion) bool { return v.name == patchName })
+	if end < 0 {
+		return nil, fmt.Errorf("%q not found in %q", patchName, dir)
+	}
+
+	for start := end; start >= 0; start-- {
+		if IsPatchFile(versions[start].name) {
+			continue
+		}
+
+		chain := make([]string, 0, end-start+1)
+		for _, v := range versions[start : end+1] {
+			chain = append(chain, v.name)
+		}
+
+		return chain, nil
+	}
+
+	return nil, fmt.Errorf("no keyframe found for %q in %q", patchName, dir)
+}
+
+// storedVersion is a file in an object directory, see IsVersionFile.
+type storedVersion struct {
+	name     string
+	session  int
+	sequence uint64
+	observed time.Time
+}
+
+// listVersions returns the stored versions of an object directory, ordered by
+// session and sequence number.
+func listVersions(dir string) ([]storedVersion, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadDir() failed: %w", err)
+	}
+
+	starts, err := findSessionStarts(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []storedVersion
+
+	for _, entry := range entries {
+		if entry.IsDir() || !IsVersionFile(entry.Name()) {
+			continue
+		}
+
+		observed, seq, _, err := ParseVersionFileName(entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("ParseVersionFileName() failed: %w", err)
+		}
+
+		versions = append(versions, storedVersion{
+			name:     entry.Name(),
+			session:  sessionIndex(starts, entry.Name()),
+			sequence: seq,
+			observed: observed,
+		})
+	}
+
+	slices.SortFunc(versions, func(a, b storedVersion) int {
+		return cmp.Or(cmp.Compare(a.session, b.session), cmp.Compare(a.sequence, b.sequence),
+			strings.Compare(a.name, b.name))
+	})
+
+	return versions, nil
+}
+
+func readFullVersion(file string) (*unstructured.Unstructured, error) {
+	data, err := ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("yaml.YAMLToJSON() failed %q: %w", file, err)
+	}
+
+	obj := &unstructured.Unstructured{}
+
+	err = obj.UnmarshalJSON(jsonData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %q: %w", file, err)
+	}
+
+	return obj, nil
+}
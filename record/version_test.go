@@ -0,0 +1,127 @@
+package record
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func newTestConfigMap(session string, version int) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]any{
+			"name":            "cm",
+			"namespace":       "default",
+			"resourceVersion": fmt.Sprint(version),
+			"labels":          map[string]any{"session": session},
+		},
+		"data": map[string]any{"version": fmt.Sprint(version)},
+	}}
+}
+
+var testConfigMapRef = ObjectRef{Group: "core", Kind: "ConfigMap", Namespace: "default", Name: "cm"}
+
+// recordTestSession records versions of a ConfigMap like a `record` run. The
+// sequence numbers start at 1 in each session. It returns the basenames of
+// the versions.
+func recordTestSession(t *testing.T, baseDir string, opts StoreOptions, session string, start time.Time, versions int) []string {
+	t.Helper()
+
+	store, err := DirStoreFactory(opts)(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.StartSession(SessionInfo{Start: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+
+	for i := 1; i <= versions; i++ {
+		eventType := watch.Modified
+		if i == 1 {
+			eventType = watch.Added
+		}
+
+		meta := VersionMeta{
+			EventType: eventType,
+			Sequence:  uint64(i),
+			Observed:  start.Add(time.Duration(i) * time.Second),
+		}
+
+		err := store.PutVersion(testConfigMapRef, meta, newTestConfigMap(session, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names = append(names, VersionFileName(meta.Observed, meta.Sequence, ""))
+	}
+
+	err = store.EndSession(start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return names
+}
+
+// objectDir returns the directory of testConfigMapRef.
+func objectDir(baseDir string) string {
+	return filepath.Join(baseDir, testConfigMapRef.Group, testConfigMapRef.Kind, testConfigMapRef.Namespace,
+		testConfigMapRef.Name)
+}
+
+// findVersionFile returns the basename of the stored version with the prefix
+// returned by recordTestSession.
+func findVersionFile(t *testing.T, dir, prefix string) string {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(dir, prefix+".*"))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("version %q not found in %q: %v %v", prefix, dir, matches, err)
+	}
+
+	return filepath.Base(matches[0])
+}
+
+func TestReadVersionOfSeveralSessions(t *testing.T) {
+	baseDir := t.TempDir()
+	opts := StoreOptions{KeyframeInterval: 20}
+	start := time.Date(2025, 2, 27, 15, 0, 0, 0, time.UTC)
+
+	// The sequence numbers of both sessions interleave: 1..6 and 1..3.
+	first := recordTestSession(t, baseDir, opts, "first", start, 6)
+	second := recordTestSession(t, baseDir, opts, "second", start.Add(2*time.Hour), 3)
+
+	dir := objectDir(baseDir)
+
+	for session, names := range map[string][]string{"first": first, "second": second} {
+		for i, prefix := range names {
+			name := findVersionFile(t, dir, prefix)
+			if i > 0 && !IsPatchFile(name) {
+				t.Errorf("%q should be stored as patch", name)
+			}
+
+			obj, err := ReadVersion(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := obj.GetLabels()["session"]; got != session {
+				t.Errorf("%q: got label of session %q, want %q", name, got, session)
+			}
+
+			want := fmt.Sprint(i + 1)
+			if got, _, _ := unstructured.NestedString(obj.Object, "data", "version"); got != want {
+				t.Errorf("%q: got version %q, want %q", name, got, want)
+			}
+		}
+	}
+}
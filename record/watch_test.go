@@ -0,0 +1,176 @@
+package record
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var testConfigMapGVR = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+func newWatchedConfigMap(name, resourceVersion string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]any{
+			"name":            name,
+			"namespace":       "default",
+			"resourceVersion": resourceVersion,
+		},
+	}}
+}
+
+func newConfigMapList(resourceVersion string, items ...*unstructured.Unstructured) *unstructured.UnstructuredList {
+	list := &unstructured.UnstructuredList{}
+	list.SetAPIVersion("v1")
+	list.SetKind("ConfigMapList")
+	list.SetResourceVersion(resourceVersion)
+
+	for _, item := range items {
+		list.Items = append(list.Items, *item)
+	}
+
+	return list
+}
+
+// watchCall is a Watch request of the gvrWatcher.
+type watchCall struct {
+	resourceVersion string
+	watcher         *watch.FakeWatcher
+}
+
+// TestGVRWatcherResumeAndRelist resumes a closed watch at the last
+// resourceVersion and at a bookmark. After 410 Gone the resource gets listed
+// again, and the differences to the known objects get reported.
+func TestGVRWatcherResumeAndRelist(t *testing.T) {
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{testConfigMapGVR: "ConfigMapList"})
+
+	lists := []*unstructured.UnstructuredList{
+		newConfigMapList("10",
+			newWatchedConfigMap("a", "1"), newWatchedConfigMap("b", "1"), newWatchedConfigMap("d", "1")),
+		// a was deleted, b changed, c was created, d is unchanged.
+		newConfigMapList("30",
+			newWatchedConfigMap("b", "20"), newWatchedConfigMap("c", "21"), newWatchedConfigMap("d", "1")),
+	}
+
+	client.PrependReactor("list", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if len(lists) == 0 {
+			return true, nil, fmt.Errorf("unexpected List")
+		}
+
+		list := lists[0]
+		lists = lists[1:]
+
+		return true, list, nil
+	})
+
+	watches := make(chan watchCall)
+
+	client.PrependWatchReactor("configmaps", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		watcher := watch.NewFake()
+		watches <- watchCall{
+			resourceVersion: action.(k8stesting.WatchAction).GetWatchRestrictions().ResourceVersion,
+			watcher:         watcher,
+		}
+
+		return true, watcher, nil
+	})
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+
+	onEvent := func(event watch.Event, initialList bool) error {
+		obj, _ := event.Object.(*unstructured.Unstructured)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		events = append(events, fmt.Sprintf("%s %s %s %v", event.Type, obj.GetName(), obj.GetResourceVersion(), initialList))
+
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := newGVRWatcher(client, testConfigMapGVR, metav1.NamespaceAll, metav1.ListOptions{}, onEvent)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		w.run(ctx)
+	}()
+
+	nextWatch := func(wantResourceVersion string) *watch.FakeWatcher {
+		t.Helper()
+
+		select {
+		case call := <-watches:
+			if call.resourceVersion != wantResourceVersion {
+				t.Errorf("watch started at resourceVersion %q, want %q", call.resourceVersion, wantResourceVersion)
+			}
+
+			return call.watcher
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no watch at resourceVersion %q", wantResourceVersion)
+			return nil
+		}
+	}
+
+	// The first watch starts at the resourceVersion of the List.
+	watcher := nextWatch("10")
+	watcher.Modify(newWatchedConfigMap("a", "11"))
+	watcher.Stop()
+
+	// It gets resumed at the last event.
+	watcher = nextWatch("11")
+	watcher.Action(watch.Bookmark, newWatchedConfigMap("", "15"))
+	watcher.Stop()
+
+	// It gets resumed at the bookmark.
+	watcher = nextWatch("15")
+	watcher.Error(&metav1.Status{
+		Status: metav1.StatusFailure,
+		Code:   http.StatusGone,
+		Reason: metav1.StatusReasonExpired,
+	})
+
+	// After the relist, the watch starts at the resourceVersion of the new List.
+	nextWatch("30")
+	cancel()
+	<-done
+
+	want := []string{
+		"ADDED a 1 true",
+		"ADDED b 1 true",
+		"ADDED d 1 true",
+		"MODIFIED a 11 false",
+		"MODIFIED b 20 false",
+		"ADDED c 21 false",
+		// The tombstone contains the last known state.
+		"DELETED a 11 false",
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !slices.Equal(events, want) {
+		t.Errorf("got events\n%v\nwant\n%v", events, want)
+	}
+}